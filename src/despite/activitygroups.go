@@ -0,0 +1,146 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// activitySession is one non-idle row of pg_stat_activity
+type activitySession struct {
+	State    string
+	Wait     string
+	Duration time.Duration
+	Query    string
+}
+
+// activityGroup is every session running the same normalized query
+type activityGroup struct {
+	Fingerprint string
+	Query       string
+	Count       int
+	Total       time.Duration
+	Max         time.Duration
+	States      map[string]int
+	Waits       map[string]int
+}
+
+// groupActivity groups sessions by query fingerprint, largest group first
+func groupActivity(sessions []activitySession) []*activityGroup {
+	var groups []*activityGroup
+	byFingerprint := make(map[string]*activityGroup)
+	for _, s := range sessions {
+		normalized := normalizeQuery(s.Query)
+		fingerprint := queryFingerprint(s.Query)
+		g, ok := byFingerprint[fingerprint]
+		if !ok {
+			g = &activityGroup{
+				Fingerprint: fingerprint,
+				Query:       normalized,
+				States:      make(map[string]int),
+				Waits:       make(map[string]int),
+			}
+			byFingerprint[fingerprint] = g
+			groups = append(groups, g)
+		}
+		g.Count++
+		g.Total += s.Duration
+		if s.Duration > g.Max {
+			g.Max = s.Duration
+		}
+		g.States[s.State]++
+		if s.Wait != "" {
+			g.Waits[s.Wait]++
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Total > groups[j].Total
+	})
+	return groups
+}
+
+// countSummary lists counts as "name count", most frequent first
+func countSummary(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %d", name, counts[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func activityGroupsReport() (*report, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT coalesce(state, ''),
+    coalesce(wait_event_type || ':' || wait_event, ''),
+    coalesce(extract(epoch FROM clock_timestamp() - query_start), 0),
+    coalesce(query, '')
+  FROM pg_stat_activity
+  WHERE state <> 'idle' AND query <> ''
+    AND pid <> pg_backend_pid()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []activitySession
+	for rows.Next() {
+		var s activitySession
+		var seconds float64
+		if err := rows.Scan(&s.State, &s.Wait, &seconds, &s.Query); err != nil {
+			return nil, err
+		}
+		s.Duration = time.Duration(seconds * float64(time.Second))
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	r := &report{Header: []string{"Fingerprint", "Count", "TotalDuration", "MaxDuration", "States", "WaitEvents", "Query"}}
+	for _, g := range groupActivity(sessions) {
+		r.Append([]string{g.Fingerprint, strconv.Itoa(g.Count),
+			g.Total.Round(time.Millisecond).String(), g.Max.Round(time.Millisecond).String(),
+			countSummary(g.States), countSummary(g.Waits), shortQuery(g.Query, 60)})
+	}
+	r.Notes = append(r.Notes, fmt.Sprintf("%d sessions in %d groups, durations are since each query started",
+		len(sessions), len(r.Rows)))
+	return r, nil
+}
+
+func activityGroupsCmd(ctx *cli.Context) error {
+	return runReport(ctx, activityGroupsReport)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupActivity(t *testing.T) {
+	sessions := []activitySession{
+		{"active", "Lock:relation", 3 * time.Second, "UPDATE orders SET total = 1 WHERE id = 1"},
+		{"active", "", time.Second, "SELECT 1"},
+		{"idle in transaction", "", 10 * time.Second, "UPDATE orders SET total = 2 WHERE id = 99"},
+		{"active", "Lock:relation", 2 * time.Second, "update orders set total = 3 where id = 5"},
+	}
+	groups := groupActivity(sessions)
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(groups))
+	}
+	g := groups[0]
+	if g.Count != 3 || g.Total != 15*time.Second || g.Max != 10*time.Second {
+		t.Errorf("unexpected group %+v", g)
+	}
+	if s := countSummary(g.States); s != "active 2, idle in transaction 1" {
+		t.Errorf("states are %q", s)
+	}
+	if s := countSummary(g.Waits); s != "Lock:relation 2" {
+		t.Errorf("waits are %q", s)
+	}
+}
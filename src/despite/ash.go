@@ -0,0 +1,295 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const ashChartWidth = 50
+
+// ashSample is one active session seen in one poll of pg_stat_activity
+type ashSample struct {
+	At            time.Time `json:"at"`
+	Pid           int       `json:"pid"`
+	State         string    `json:"state"`
+	WaitEventType string    `json:"wait_event_type"`
+	WaitEvent     string    `json:"wait_event"`
+	Query         string    `json:"query"`
+}
+
+// ashTick is everything seen in a single poll
+type ashTick struct {
+	At       time.Time
+	Sessions []ashSample
+}
+
+// ashRing keeps the most recent ticks, overwriting the oldest once full
+type ashRing struct {
+	ticks []ashTick
+	next  int
+	full  bool
+}
+
+func newASHRing(size int) *ashRing {
+	if size < 1 {
+		size = 1
+	}
+	return &ashRing{ticks: make([]ashTick, size)}
+}
+
+func (r *ashRing) Add(t ashTick) {
+	r.ticks[r.next] = t
+	r.next = (r.next + 1) % len(r.ticks)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Ticks returns the buffered ticks, oldest first
+func (r *ashRing) Ticks() []ashTick {
+	if !r.full {
+		return append([]ashTick(nil), r.ticks[:r.next]...)
+	}
+	return append(append([]ashTick(nil), r.ticks[r.next:]...), r.ticks[:r.next]...)
+}
+
+// waitEventName labels a sample by what it is waiting on. Active sessions
+// that are not waiting are on CPU, or at least not in a reported wait.
+func (s ashSample) waitEventName() string {
+	if s.WaitEventType == "" {
+		return "CPU"
+	}
+	return s.WaitEventType + ":" + s.WaitEvent
+}
+
+// pollActivity reads the active sessions. Every tick is stamped with the
+// server clock, read on its own so that a tick with no sessions is on the
+// same time axis as the others.
+func pollActivity(db *sql.DB) (ashTick, error) {
+	var tick ashTick
+	if err := db.QueryRow(`SELECT clock_timestamp()`).Scan(&tick.At); err != nil {
+		return tick, err
+	}
+	rows, err := db.Query(`SELECT pid, coalesce(state, ''),
+    coalesce(wait_event_type, ''), coalesce(wait_event, ''), coalesce(query, '')
+  FROM pg_stat_activity
+  WHERE state = 'active'
+    AND pid <> pg_backend_pid()`)
+	if err != nil {
+		return tick, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := ashSample{At: tick.At}
+		err := rows.Scan(&s.Pid, &s.State, &s.WaitEventType, &s.WaitEvent, &s.Query)
+		if err != nil {
+			return tick, err
+		}
+		tick.Sessions = append(tick.Sessions, s)
+	}
+	return tick, rows.Err()
+}
+
+// sampleActivity polls pg_stat_activity every interval until duration has
+// passed or a signal arrives on stop. Every sample is also written to persist as a
+// JSON line when persist is not nil.
+func sampleActivity(ring *ashRing, interval, duration time.Duration, persist io.Writer, stop <-chan os.Signal) error {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	version, err := serverVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < 90600 {
+		return fmt.Errorf("sampling wait events needs PostgreSQL 9.6 or later")
+	}
+	var enc *json.Encoder
+	if persist != nil {
+		enc = json.NewEncoder(persist)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.After(duration)
+	for {
+		tick, err := pollActivity(db)
+		if err != nil {
+			return err
+		}
+		ring.Add(tick)
+		if enc != nil {
+			for _, s := range tick.Sessions {
+				if err := enc.Encode(s); err != nil {
+					return err
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return nil
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// countedReport renders counts as a report sorted by count, with the share
+// of the total and the average number of sessions over ticks polls.
+func countedReport(label string, counts map[string]int, ticks int, limit int) *report {
+	keys := make([]string, 0, len(counts))
+	total := 0
+	for k, n := range counts {
+		keys = append(keys, k)
+		total += n
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	r := &report{Header: []string{label, "Samples", "Percent", "AvgActive"}}
+	for _, k := range keys {
+		n := counts[k]
+		r.Append([]string{
+			k,
+			strconv.Itoa(n),
+			fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total)),
+			fmt.Sprintf("%.2f", float64(n)/float64(ticks)),
+		})
+	}
+	return r
+}
+
+// ashProfile summarizes ticks into the wait event and query profiles
+func ashProfile(ticks []ashTick) (waits *report, queries *report) {
+	waitCounts := make(map[string]int)
+	queryCounts := make(map[string]int)
+	for _, t := range ticks {
+		for _, s := range t.Sessions {
+			waitCounts[s.waitEventName()]++
+			queryCounts[shortQuery(s.Query, 60)]++
+		}
+	}
+	return countedReport("WaitEvent", waitCounts, len(ticks), 0),
+		countedReport("Query", queryCounts, len(ticks), 10)
+}
+
+// activeSessionChart draws the average number of active sessions in each
+// second as a horizontal bar.
+func activeSessionChart(output io.Writer, ticks []ashTick) {
+	var seconds []time.Time
+	sums := make(map[time.Time]int)
+	polls := make(map[time.Time]int)
+	for _, t := range ticks {
+		sec := t.At.Truncate(time.Second)
+		if polls[sec] == 0 {
+			seconds = append(seconds, sec)
+		}
+		polls[sec]++
+		sums[sec] += len(t.Sessions)
+	}
+	max := 0.0
+	for _, sec := range seconds {
+		if avg := float64(sums[sec]) / float64(polls[sec]); avg > max {
+			max = avg
+		}
+	}
+	for _, sec := range seconds {
+		avg := float64(sums[sec]) / float64(polls[sec])
+		width := 0
+		if max > 0 {
+			width = int(avg / max * ashChartWidth)
+		}
+		fmt.Fprintf(output, "%s %6.2f |%s\n", sec.Format("15:04:05"), avg, strings.Repeat("#", width))
+	}
+}
+
+// shortQuery collapses whitespace and truncates query to length characters
+// for display
+func shortQuery(query string, length int) string {
+	q := []rune(strings.Join(strings.Fields(query), " "))
+	if len(q) > length {
+		return string(q[:length-3]) + "..."
+	}
+	return string(q)
+}
+
+func ash(output io.Writer, ticks []ashTick) {
+	if len(ticks) == 0 {
+		fmt.Fprintln(output, "no samples collected")
+		return
+	}
+	waits, queries := ashProfile(ticks)
+	fmt.Fprintf(output, "%d samples from %s to %s\n\n", len(ticks),
+		ticks[0].At.Format(time.RFC3339), ticks[len(ticks)-1].At.Format(time.RFC3339))
+	renderReport(output, waits)
+	fmt.Fprintln(output)
+	renderReport(output, queries)
+	fmt.Fprintln(output)
+	activeSessionChart(output, ticks)
+}
+
+func ashCmd(ctx *cli.Context) error {
+	hz := ctx.Int("hz")
+	if hz < 1 {
+		return cli.NewExitError("--hz must be at least 1", 1)
+	}
+	duration := ctx.Duration("duration")
+	window := ctx.Duration("window")
+	if window <= 0 {
+		window = duration
+	}
+	interval := time.Second / time.Duration(hz)
+	ring := newASHRing(int(window.Seconds()) * hz)
+	var persist io.Writer
+	if filename := ctx.String("output"); filename != "" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+		}
+		defer f.Close()
+		persist = f
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+	fmt.Fprintf(os.Stderr, "sampling pg_stat_activity at %dHz for %s, interrupt to report early\n", hz, duration)
+	err := sampleActivity(ring, interval, duration, persist, stop)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	ash(os.Stdout, ring.Ticks())
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestASHRingKeepsNewestTicks(t *testing.T) {
+	ring := newASHRing(3)
+	start := time.Date(2016, 9, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		ring.Add(ashTick{At: start.Add(time.Duration(i) * time.Second)})
+	}
+	ticks := ring.Ticks()
+	if len(ticks) != 3 {
+		t.Fatalf("ring holds %d ticks, expected 3", len(ticks))
+	}
+	for i, tick := range ticks {
+		if expected := start.Add(time.Duration(i+2) * time.Second); !tick.At.Equal(expected) {
+			t.Errorf("tick %d is at %s, expected %s", i, tick.At, expected)
+		}
+	}
+}
+
+func TestASHProfileWaitEvents(t *testing.T) {
+	ticks := []ashTick{
+		{Sessions: []ashSample{
+			{Query: "select 1"},
+			{WaitEventType: "Lock", WaitEvent: "relation", Query: "alter table t"},
+		}},
+		{Sessions: []ashSample{
+			{WaitEventType: "Lock", WaitEvent: "relation", Query: "alter table t"},
+			{WaitEventType: "Lock", WaitEvent: "relation", Query: "select  *\n from t"},
+		}},
+	}
+	waits, _ := ashProfile(ticks)
+	expected := [][]string{
+		{"Lock:relation", "3", "75.0%", "1.50"},
+		{"CPU", "1", "25.0%", "0.50"},
+	}
+	if !reflect.DeepEqual(waits.Rows, expected) {
+		t.Errorf("wait profile is %v, expected %v", waits.Rows, expected)
+	}
+}
+
+func TestShortQueryCutsByCharacter(t *testing.T) {
+	q := shortQuery("SELECT * FROM café_événements   WHERE nom = 'élan'", 21)
+	expected := "SELECT * FROM café..."
+	if q != expected {
+		t.Errorf("shortQuery is %q, expected %q", q, expected)
+	}
+	if q := shortQuery("SELECT   1", 20); q != "SELECT 1" {
+		t.Errorf("shortQuery is %q, expected %q", q, "SELECT 1")
+	}
+}
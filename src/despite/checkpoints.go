@@ -0,0 +1,178 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/urfave/cli"
+)
+
+// checkpointStats is pg_stat_bgwriter, or pg_stat_checkpointer and
+// pg_stat_io on 17 and later, reduced to the counters we interpret.
+type checkpointStats struct {
+	Timed     int64
+	Requested int64
+	// Done counts checkpoints actually performed. Before 18 timed
+	// checkpoints skipped on an idle server cannot be told apart, so it is
+	// timed plus requested.
+	Done           int64
+	WriteTime      float64 // milliseconds
+	SyncTime       float64 // milliseconds
+	BuffersCkpt    int64
+	BuffersClean   int64
+	MaxWritten     int64
+	BuffersBackend int64
+	BackendFsync   int64
+	BuffersAlloc   int64
+	StatsReset     string
+	MaxWalSize     string
+	Timeout        string
+	LruMaxPages    string
+	// Rounds estimates how many times the background writer has woken up
+	// since the stats reset, from bgwriter_delay. It hibernates when idle,
+	// so this is an upper bound.
+	Rounds float64
+}
+
+// bgwriterRounds is the time since the stats were reset divided by
+// bgwriter_delay, which is in milliseconds
+const bgwriterRounds = `extract(epoch FROM clock_timestamp() - coalesce(%[1]s, pg_postmaster_start_time())) * 1000 /
+      (SELECT setting::float8 FROM pg_settings WHERE name = 'bgwriter_delay')`
+
+var checkpointsQuery = fmt.Sprintf(`SELECT checkpoints_timed, checkpoints_req, checkpoints_timed + checkpoints_req,
+    checkpoint_write_time, checkpoint_sync_time,
+    buffers_checkpoint, buffers_clean, maxwritten_clean,
+    buffers_backend, buffers_backend_fsync, buffers_alloc,
+    coalesce(stats_reset::text, ''),
+    current_setting('max_wal_size'), current_setting('checkpoint_timeout'),
+    current_setting('bgwriter_lru_maxpages'),
+    `+bgwriterRounds+`
+  FROM pg_stat_bgwriter`, "stats_reset")
+
+// PG 17 moved the checkpointer counters out of pg_stat_bgwriter, and
+// backend writes are only reported through pg_stat_io. num_done, which
+// leaves out skipped checkpoints, came in 18.
+const checkpointerQuery = `SELECT c.num_timed, c.num_requested, %[2]s,
+    c.write_time, c.sync_time,
+    c.buffers_written, b.buffers_clean, b.maxwritten_clean,
+    coalesce(io.writes, 0), coalesce(io.fsyncs, 0), b.buffers_alloc,
+    coalesce(c.stats_reset::text, ''),
+    current_setting('max_wal_size'), current_setting('checkpoint_timeout'),
+    current_setting('bgwriter_lru_maxpages'),
+    ` + bgwriterRounds + `
+  FROM pg_stat_checkpointer c, pg_stat_bgwriter b,
+    (SELECT sum(writes)::bigint AS writes, sum(fsyncs)::bigint AS fsyncs
+       FROM pg_stat_io
+      WHERE backend_type = 'client backend') io`
+
+var checkpoints17Query = fmt.Sprintf(checkpointerQuery, "b.stats_reset", "c.num_timed + c.num_requested")
+
+var checkpoints18Query = fmt.Sprintf(checkpointerQuery, "b.stats_reset", "c.num_done")
+
+// checkpointsQueryFor picks the statistics query for a server version
+func checkpointsQueryFor(version int) string {
+	switch {
+	case version >= 180000:
+		return checkpoints18Query
+	case version >= 170000:
+		return checkpoints17Query
+	}
+	return checkpointsQuery
+}
+
+func readCheckpointStats(db *sql.DB) (*checkpointStats, error) {
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	s := &checkpointStats{}
+	err = db.QueryRow(checkpointsQueryFor(version)).Scan(&s.Timed, &s.Requested, &s.Done, &s.WriteTime, &s.SyncTime,
+		&s.BuffersCkpt, &s.BuffersClean, &s.MaxWritten, &s.BuffersBackend, &s.BackendFsync,
+		&s.BuffersAlloc, &s.StatsReset, &s.MaxWalSize, &s.Timeout, &s.LruMaxPages, &s.Rounds)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkpointNotes explains the numbers that usually point at a cause of
+// IO latency spikes.
+func checkpointNotes(s *checkpointStats) []string {
+	var notes []string
+	total := s.Timed + s.Requested
+	if total > 0 && float64(s.Requested)/float64(total) > 0.1 {
+		notes = append(notes, fmt.Sprintf("%.0f%% of checkpoints were requested rather than timed, "+
+			"usually because WAL reached max_wal_size (%s) before checkpoint_timeout (%s); "+
+			"consider raising max_wal_size",
+			100*float64(s.Requested)/float64(total), s.MaxWalSize, s.Timeout))
+	}
+	written := s.BuffersCkpt + s.BuffersClean + s.BuffersBackend
+	if written > 0 && float64(s.BuffersBackend)/float64(written) > 0.1 {
+		notes = append(notes, fmt.Sprintf("backends wrote %.0f%% of buffers themselves instead of "+
+			"leaving it to the checkpointer or background writer, which adds latency to queries; "+
+			"shared_buffers or bgwriter_lru_maxpages (%s) may be too low",
+			100*float64(s.BuffersBackend)/float64(written), s.LruMaxPages))
+	}
+	if s.BackendFsync > 0 {
+		notes = append(notes, fmt.Sprintf("backends had to fsync %d times themselves because the "+
+			"checkpointer request queue was full", s.BackendFsync))
+	}
+	if s.Rounds > 0 && float64(s.MaxWritten)/s.Rounds > 0.05 {
+		notes = append(notes, fmt.Sprintf("the background writer stopped after writing "+
+			"bgwriter_lru_maxpages (%s) buffers in %.0f%% of its rounds; raise it if backends are writing too",
+			s.LruMaxPages, 100*float64(s.MaxWritten)/s.Rounds))
+	}
+	return notes
+}
+
+func checkpointsReport() (*report, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	s, err := readCheckpointStats(db)
+	if err != nil {
+		return nil, err
+	}
+	avg := func(ms float64) string {
+		if s.Done == 0 {
+			return "0"
+		}
+		return strconv.FormatFloat(ms/float64(s.Done), 'f', 1, 64)
+	}
+	r := &report{Header: []string{"Metric", "Value"}}
+	r.Append([]string{"checkpoints timed", strconv.FormatInt(s.Timed, 10)})
+	r.Append([]string{"checkpoints requested", strconv.FormatInt(s.Requested, 10)})
+	r.Append([]string{"checkpoints performed", strconv.FormatInt(s.Done, 10)})
+	r.Append([]string{"avg write time (ms)", avg(s.WriteTime)})
+	r.Append([]string{"avg sync time (ms)", avg(s.SyncTime)})
+	r.Append([]string{"buffers written by checkpointer", strconv.FormatInt(s.BuffersCkpt, 10)})
+	r.Append([]string{"buffers written by bgwriter", strconv.FormatInt(s.BuffersClean, 10)})
+	r.Append([]string{"buffers written by backends", strconv.FormatInt(s.BuffersBackend, 10)})
+	r.Append([]string{"backend fsyncs", strconv.FormatInt(s.BackendFsync, 10)})
+	r.Append([]string{"bgwriter maxwritten_clean", strconv.FormatInt(s.MaxWritten, 10)})
+	r.Append([]string{"buffers allocated", strconv.FormatInt(s.BuffersAlloc, 10)})
+	r.Append([]string{"stats reset", s.StatsReset})
+	r.Notes = checkpointNotes(s)
+	return r, nil
+}
+
+func checkpointsCmd(ctx *cli.Context) error {
+	return runReport(ctx, checkpointsReport)
+}
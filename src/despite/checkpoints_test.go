@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckpointNotes(t *testing.T) {
+	healthy := &checkpointStats{Timed: 100, Requested: 2, BuffersCkpt: 1000, BuffersClean: 100, BuffersBackend: 10}
+	if notes := checkpointNotes(healthy); len(notes) != 0 {
+		t.Errorf("healthy stats produced notes: %v", notes)
+	}
+	forced := &checkpointStats{Timed: 10, Requested: 30, BuffersCkpt: 100, BuffersBackend: 900,
+		MaxWalSize: "1GB", Timeout: "5min"}
+	notes := checkpointNotes(forced)
+	if len(notes) != 2 {
+		t.Fatalf("expected 2 notes, got %v", notes)
+	}
+	if !strings.Contains(notes[0], "75% of checkpoints were requested") {
+		t.Errorf("unexpected requested checkpoint note: %s", notes[0])
+	}
+	if !strings.Contains(notes[1], "backends wrote 90% of buffers") {
+		t.Errorf("unexpected backend write note: %s", notes[1])
+	}
+}
+
+func TestCheckpointNotesMaxWritten(t *testing.T) {
+	// stopping in 10 of 100000 rounds is normal on a busy server
+	busy := &checkpointStats{Timed: 100, BuffersCkpt: 1000, BuffersClean: 100000, MaxWritten: 10, Rounds: 100000}
+	if notes := checkpointNotes(busy); len(notes) != 0 {
+		t.Errorf("occasional maxwritten_clean produced notes: %v", notes)
+	}
+	starved := &checkpointStats{Timed: 100, BuffersCkpt: 1000, BuffersClean: 100000, MaxWritten: 20000,
+		Rounds: 100000, LruMaxPages: "100"}
+	notes := checkpointNotes(starved)
+	if len(notes) != 1 || !strings.Contains(notes[0], "in 20% of its rounds") {
+		t.Errorf("unexpected notes: %v", notes)
+	}
+}
+
+func TestCheckpointsQueryFor(t *testing.T) {
+	cases := []struct {
+		version int
+		query   string
+	}{
+		{160000, checkpointsQuery},
+		{170000, checkpoints17Query},
+		{180000, checkpoints18Query},
+	}
+	for _, c := range cases {
+		if checkpointsQueryFor(c.version) != c.query {
+			t.Errorf("wrong query chosen for %d", c.version)
+		}
+	}
+	if strings.Contains(checkpoints17Query, "num_done") {
+		t.Error("the PostgreSQL 17 query reads num_done, which came in 18")
+	}
+	if !strings.Contains(checkpoints18Query, "c.num_done") {
+		t.Error("the PostgreSQL 18 query does not read num_done")
+	}
+}
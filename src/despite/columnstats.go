@@ -0,0 +1,244 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	// lowCorrelation is where an index range scan on the column starts
+	// reading most of the table's pages in random order.
+	lowCorrelation = 0.5
+	// staleModifiedRatio is the share of rows modified since the last
+	// analyze above which estimates may be off, the default
+	// autovacuum_analyze_scale_factor.
+	staleModifiedRatio = 0.1
+	mostCommonShown    = 3
+)
+
+// columnStats is one row of pg_stats with the arrays still as text
+type columnStats struct {
+	Column      string
+	NullFrac    float64
+	NDistinct   float64
+	Correlation sql.NullFloat64
+	MostCommon  sql.NullString
+	Frequencies sql.NullString
+	Histogram   sql.NullString
+}
+
+// parsePGArray splits the text form of a one-dimensional array into its
+// elements, removing quotes and backslash escapes.
+func parsePGArray(s string) []string {
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil
+	}
+	s = s[1 : len(s)-1]
+	var elements []string
+	var current []byte
+	quoted, inQuotes, escaped := false, false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			current = append(current, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case c == ',' && !inQuotes:
+			elements = append(elements, string(current))
+			current, quoted = nil, false
+		default:
+			current = append(current, c)
+		}
+	}
+	if len(current) > 0 || quoted || len(elements) > 0 {
+		elements = append(elements, string(current))
+	}
+	return elements
+}
+
+// absoluteDistinct turns n_distinct, which is negative when it is a
+// fraction of the row count, into an estimated number of distinct values.
+func absoluteDistinct(nDistinct, rows float64) float64 {
+	if nDistinct < 0 {
+		return math.Floor(-nDistinct*math.Max(rows, 0) + 0.5)
+	}
+	return nDistinct
+}
+
+func mostCommonSummary(values, frequencies string) string {
+	v, f := parsePGArray(values), parsePGArray(frequencies)
+	var parts []string
+	for i := 0; i < len(v) && i < len(f) && i < mostCommonShown; i++ {
+		freq, _ := strconv.ParseFloat(f[i], 64)
+		parts = append(parts, fmt.Sprintf("%s (%.1f%%)", shortQuery(v[i], 20), freq*100))
+	}
+	if len(v) > mostCommonShown {
+		parts = append(parts, fmt.Sprintf("+%d more", len(v)-mostCommonShown))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func histogramSummary(bounds string) string {
+	b := parsePGArray(bounds)
+	if len(b) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("%d buckets, %s to %s", len(b)-1, shortQuery(b[0], 20), shortQuery(b[len(b)-1], 20))
+}
+
+func columnStatsRow(s columnStats, rows float64) []string {
+	correlation := ""
+	if s.Correlation.Valid {
+		correlation = fmt.Sprintf("%.2f", s.Correlation.Float64)
+		if math.Abs(s.Correlation.Float64) < lowCorrelation {
+			correlation += " low"
+		}
+	}
+	return []string{
+		s.Column,
+		fmt.Sprintf("%.1f%%", s.NullFrac*100),
+		strconv.FormatFloat(absoluteDistinct(s.NDistinct, rows), 'f', 0, 64),
+		correlation,
+		mostCommonSummary(s.MostCommon.String, s.Frequencies.String),
+		histogramSummary(s.Histogram.String),
+	}
+}
+
+// stalenessNote warns when enough rows changed since the last analyze for
+// the statistics to no longer describe the table.
+func stalenessNote(rows float64, modified int64, lastAnalyzed string) string {
+	if lastAnalyzed == "" {
+		return "the table has never been analyzed, run ANALYZE before trusting any estimate"
+	}
+	if modified > 0 && float64(modified) > staleModifiedRatio*math.Max(rows, 1) {
+		return fmt.Sprintf("STALE: %d rows modified since the last analyze at %s, about %.0f%% of the table",
+			modified, lastAnalyzed, 100*float64(modified)/math.Max(rows, 1))
+	}
+	return fmt.Sprintf("last analyzed at %s, %d rows modified since", lastAnalyzed, modified)
+}
+
+func readColumnStats(db *sql.DB, table string) ([]columnStats, error) {
+	rows, err := db.Query(`SELECT s.attname, s.null_frac, s.n_distinct, s.correlation,
+    s.most_common_vals::text, s.most_common_freqs::text, s.histogram_bounds::text
+  FROM pg_stats s
+    JOIN pg_class c ON c.relname = s.tablename
+    JOIN pg_namespace n ON n.oid = c.relnamespace AND n.nspname = s.schemaname
+    JOIN pg_attribute a ON a.attrelid = c.oid AND a.attname = s.attname
+  WHERE c.oid = $1::regclass AND s.inherited = (c.relkind = 'p')
+  ORDER BY a.attnum`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stats []columnStats
+	for rows.Next() {
+		var s columnStats
+		err := rows.Scan(&s.Column, &s.NullFrac, &s.NDistinct, &s.Correlation, &s.MostCommon, &s.Frequencies, &s.Histogram)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// extendedStatsNotes describes CREATE STATISTICS objects on the table
+func extendedStatsNotes(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(`SELECT quote_ident(s.stxname),
+    array_to_string(ARRAY(SELECT CASE k WHEN 'd' THEN 'ndistinct' WHEN 'f' THEN 'dependencies'
+                                        WHEN 'm' THEN 'mcv' WHEN 'e' THEN 'expressions' ELSE k::text END
+                            FROM unnest(s.stxkind) k), ', '),
+    array_to_string(ARRAY(SELECT quote_ident(a.attname) FROM pg_attribute a
+                           WHERE a.attrelid = s.stxrelid AND a.attnum = ANY (s.stxkeys)
+                           ORDER BY a.attnum), ', ')
+  FROM pg_statistic_ext s
+  WHERE s.stxrelid = $1::regclass
+  ORDER BY s.stxname`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var notes []string
+	for rows.Next() {
+		var name, kinds, columns string
+		if err := rows.Scan(&name, &kinds, &columns); err != nil {
+			return nil, err
+		}
+		notes = append(notes, fmt.Sprintf("extended statistics %s (%s) on %s", name, kinds, columns))
+	}
+	return notes, rows.Err()
+}
+
+func columnStatsReport(table string) reportFunc {
+	return func() (*report, error) {
+		db, err := sql.Open("postgres", dburi)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		var reltuples float64
+		var modified int64
+		var lastAnalyzed string
+		err = db.QueryRow(`SELECT c.reltuples, coalesce(s.n_mod_since_analyze, 0),
+    coalesce(to_char(greatest(s.last_analyze, s.last_autoanalyze), 'YYYY-MM-DD HH24:MI:SS TZ'), '')
+  FROM pg_class c LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+  WHERE c.oid = $1::regclass`, table).Scan(&reltuples, &modified, &lastAnalyzed)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := readColumnStats(db, table)
+		if err != nil {
+			return nil, err
+		}
+		r := &report{Header: []string{"Column", "Nulls", "Distinct", "Correlation", "MostCommon", "Histogram"}}
+		for _, s := range stats {
+			r.Append(columnStatsRow(s, reltuples))
+		}
+		r.Notes = append(r.Notes, stalenessNote(reltuples, modified, lastAnalyzed))
+		version, err := serverVersion(db)
+		if err != nil {
+			return nil, err
+		}
+		if version >= 100000 {
+			notes, err := extendedStatsNotes(db, table)
+			if err != nil {
+				return nil, err
+			}
+			r.Notes = append(r.Notes, notes...)
+		}
+		r.Notes = append(r.Notes, fmt.Sprintf("correlation below %.1f makes index range scans read the table in "+
+			"random order", lowCorrelation))
+		return r, nil
+	}
+}
+
+func columnStatsCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("usage: despite pg:column-stats TABLE", 1)
+	}
+	return runReport(ctx, columnStatsReport(ctx.Args().First()))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestParsePGArray(t *testing.T) {
+	cases := map[string][]string{
+		`{}`:                         nil,
+		`{1,2,3}`:                    {"1", "2", "3"},
+		`{"a b","say \"hi\"",NULL}`:  {"a b", `say "hi"`, "NULL"},
+		`{"",x}`:                     {"", "x"},
+		`{"2016-01-01 00:00:00+00"}`: {"2016-01-01 00:00:00+00"},
+	}
+	for input, expected := range cases {
+		if elements := parsePGArray(input); !reflect.DeepEqual(elements, expected) {
+			t.Errorf("parsePGArray(%q) is %q, expected %q", input, elements, expected)
+		}
+	}
+}
+
+func TestColumnStatsRow(t *testing.T) {
+	s := columnStats{
+		Column:      "status",
+		NullFrac:    0.25,
+		NDistinct:   -0.5,
+		Correlation: sql.NullFloat64{Float64: 0.1, Valid: true},
+		MostCommon:  sql.NullString{String: "{new,paid,shipped,void}", Valid: true},
+		Frequencies: sql.NullString{String: "{0.5,0.25,0.125,0.0625}", Valid: true},
+		Histogram:   sql.NullString{String: "{a,m,z}", Valid: true},
+	}
+	expected := []string{"status", "25.0%", "500", "0.10 low",
+		"new (50.0%), paid (25.0%), shipped (12.5%), +1 more", "2 buckets, a to z"}
+	if row := columnStatsRow(s, 1000); !reflect.DeepEqual(row, expected) {
+		t.Errorf("row is %q, expected %q", row, expected)
+	}
+}
+
+func TestStalenessNote(t *testing.T) {
+	if note := stalenessNote(1000, 500, "2016-01-01 00:00:00 UTC"); note[:6] != "STALE:" {
+		t.Errorf("expected the statistics to be stale, got %q", note)
+	}
+	if note := stalenessNote(1000, 5, "2016-01-01 00:00:00 UTC"); note[:6] == "STALE:" {
+		t.Errorf("expected the statistics to be fresh, got %q", note)
+	}
+}
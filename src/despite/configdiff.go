@@ -0,0 +1,200 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// perInstanceSettings differ between any two clusters and say nothing
+// about configuration drift, so they are left out unless --all is given.
+var perInstanceSettings = map[string]bool{
+	"application_name":      true,
+	"config_file":           true,
+	"data_directory":        true,
+	"external_pid_file":     true,
+	"hba_file":              true,
+	"ident_file":            true,
+	"in_hot_standby":        true,
+	"transaction_read_only": true,
+}
+
+var settingUnitPattern = regexp.MustCompile(`^([0-9]*)(B|kB|MB|GB|TB|us|ms|s|min|h|d)$`)
+
+var settingUnitSizes = map[string]float64{
+	"B": 1, "kB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40,
+}
+
+var settingUnitDurations = map[string]time.Duration{
+	"us": time.Microsecond, "ms": time.Millisecond, "s": time.Second,
+	"min": time.Minute, "h": time.Hour, "d": 24 * time.Hour,
+}
+
+// clusterSetting is one row of pg_settings
+type clusterSetting struct {
+	Value  string
+	Source string
+}
+
+// exactBytes formats a size in the largest unit that represents it
+// exactly, so that sizes which differ never format the same
+func exactBytes(b int64) string {
+	for _, unit := range []string{"TB", "GB", "MB", "kB"} {
+		size := int64(settingUnitSizes[unit])
+		if b >= size && b%size == 0 {
+			return fmt.Sprintf("%d %s", b/size, unit)
+		}
+	}
+	return fmt.Sprintf("%d bytes", b)
+}
+
+// normalizeSetting converts a pg_settings value in its unit, such as 16384
+// in units of 8kB, into a readable value that compares equal regardless of
+// the unit the server reports it in. It is exact: values that differ at
+// all never normalize to the same string.
+func normalizeSetting(setting, unit string) string {
+	m := settingUnitPattern.FindStringSubmatch(unit)
+	if m == nil {
+		return setting
+	}
+	value, err := strconv.ParseFloat(setting, 64)
+	if err != nil || value < 0 {
+		// -1 usually means disabled or "use the default"
+		return setting
+	}
+	multiplier := 1.0
+	if m[1] != "" {
+		multiplier, _ = strconv.ParseFloat(m[1], 64)
+	}
+	if size, ok := settingUnitSizes[m[2]]; ok {
+		return exactBytes(int64(value * multiplier * size))
+	}
+	return time.Duration(value * multiplier * float64(settingUnitDurations[m[2]])).String()
+}
+
+func readSettings(uri string) (map[string]clusterSetting, error) {
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT name, coalesce(setting, ''), coalesce(unit, ''), source FROM pg_settings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	settings := make(map[string]clusterSetting)
+	for rows.Next() {
+		var name, setting, unit, source string
+		if err := rows.Scan(&name, &setting, &unit, &source); err != nil {
+			return nil, err
+		}
+		settings[name] = clusterSetting{normalizeSetting(setting, unit), source}
+	}
+	return settings, rows.Err()
+}
+
+// clusterLabel names a cluster by host, port and database without the
+// password from its connection URI.
+func clusterLabel(uri string, i int) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("cluster %d", i+1)
+	}
+	return u.Host + u.Path
+}
+
+// diffSettings returns a row per parameter whose value is not the same on
+// every cluster. A parameter missing from a cluster, usually because of a
+// version difference, counts as different.
+func diffSettings(labels []string, clusters []map[string]clusterSetting, all bool) *report {
+	names := make(map[string]bool)
+	for _, c := range clusters {
+		for name := range c {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if all || !perInstanceSettings[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	r := &report{Header: append([]string{"Parameter"}, labels...)}
+	for _, name := range sorted {
+		row := []string{name}
+		differs := false
+		first, firstFound := clusters[0][name]
+		for _, c := range clusters {
+			s, found := c[name]
+			if found != firstFound || s.Value != first.Value {
+				differs = true
+			}
+			if !found {
+				row = append(row, "(missing)")
+				continue
+			}
+			row = append(row, fmt.Sprintf("%s (%s)", s.Value, s.Source))
+		}
+		if differs {
+			r.Append(row)
+		}
+	}
+	return r
+}
+
+func configDiff(output io.Writer, uris []string, all bool) error {
+	var labels []string
+	var clusters []map[string]clusterSetting
+	for i, uri := range uris {
+		label := clusterLabel(uri, i)
+		settings, err := readSettings(uri)
+		if err != nil {
+			return fmt.Errorf("%s: %s", label, err)
+		}
+		labels = append(labels, label)
+		clusters = append(clusters, settings)
+	}
+	r := diffSettings(labels, clusters, all)
+	if len(r.Rows) == 0 {
+		fmt.Fprintln(output, "settings match")
+		return nil
+	}
+	renderReport(output, r)
+	return nil
+}
+
+func configDiffCmd(ctx *cli.Context) error {
+	uris := append([]string{dburi}, ctx.Args()...)
+	if len(uris) < 2 {
+		return cli.NewExitError("usage: despite --dburi URI pg:config-diff OTHER_URI...", 1)
+	}
+	err := configDiff(os.Stdout, uris, ctx.Bool("all"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeSetting(t *testing.T) {
+	cases := []struct{ setting, unit, expected string }{
+		{"16384", "8kB", "128 MB"},
+		{"131072", "kB", "128 MB"},
+		{"4096", "kB", "4 MB"},
+		{"10240", "kB", "10 MB"},
+		{"10300", "kB", "10300 kB"},
+		{"1310720", "8kB", "10 GB"},
+		{"1350000", "8kB", "10800000 kB"},
+		{"0", "B", "0 bytes"},
+		{"1500", "ms", "1.5s"},
+		{"300", "s", "5m0s"},
+		{"-1", "ms", "-1"},
+		{"on", "", "on"},
+	}
+	for _, c := range cases {
+		if got := normalizeSetting(c.setting, c.unit); got != c.expected {
+			t.Errorf("normalizeSetting(%q, %q) = %q, expected %q", c.setting, c.unit, got, c.expected)
+		}
+	}
+}
+
+func TestDiffSettings(t *testing.T) {
+	// values as readSettings produces them from pg_settings
+	primary := map[string]clusterSetting{
+		"work_mem":       {normalizeSetting("4096", "kB"), "configuration file"},
+		"shared_buffers": {normalizeSetting("16384", "8kB"), "configuration file"},
+		"data_directory": {"/var/lib/a", "override"},
+	}
+	replica := map[string]clusterSetting{
+		"work_mem":       {normalizeSetting("65536", "kB"), "configuration file"},
+		"shared_buffers": {normalizeSetting("131072", "kB"), "default"},
+		"data_directory": {"/var/lib/b", "override"},
+		"jit":            {"on", "default"},
+	}
+	r := diffSettings([]string{"primary", "replica"}, []map[string]clusterSetting{primary, replica}, false)
+	expected := [][]string{
+		{"jit", "(missing)", "on (default)"},
+		{"work_mem", "4 MB (configuration file)", "64 MB (configuration file)"},
+	}
+	if !reflect.DeepEqual(r.Rows, expected) {
+		t.Errorf("differences are %v, expected %v", r.Rows, expected)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// ddlAuditInstall creates the despite schema, the ddl_log table and the
+// event triggers that fill it. Every statement can be run again safely,
+// which also upgrades the trigger functions of an older install.
+var ddlAuditInstall = []string{
+	`CREATE SCHEMA IF NOT EXISTS despite`,
+	`CREATE TABLE IF NOT EXISTS despite.ddl_log (
+    id bigserial PRIMARY KEY,
+    at timestamptz NOT NULL DEFAULT now(),
+    role text NOT NULL DEFAULT session_user,
+    command_tag text NOT NULL,
+    object_type text,
+    object_identity text,
+    statement text DEFAULT current_query()
+  )`,
+	`CREATE INDEX IF NOT EXISTS ddl_log_at ON despite.ddl_log (at)`,
+	`CREATE OR REPLACE FUNCTION despite.log_ddl_command() RETURNS event_trigger
+    LANGUAGE plpgsql SECURITY DEFINER SET search_path = pg_catalog AS $$
+  BEGIN
+    INSERT INTO despite.ddl_log (command_tag, object_type, object_identity)
+      SELECT command_tag, object_type, object_identity
+        FROM pg_event_trigger_ddl_commands()
+        WHERE schema_name IS DISTINCT FROM 'despite';
+  END
+  $$`,
+	`CREATE OR REPLACE FUNCTION despite.log_dropped_object() RETURNS event_trigger
+    LANGUAGE plpgsql SECURITY DEFINER SET search_path = pg_catalog AS $$
+  BEGIN
+    INSERT INTO despite.ddl_log (command_tag, object_type, object_identity)
+      SELECT tg_tag, object_type, object_identity
+        FROM pg_event_trigger_dropped_objects()
+        WHERE original AND schema_name IS DISTINCT FROM 'despite';
+  END
+  $$`,
+	`DROP EVENT TRIGGER IF EXISTS despite_ddl_command`,
+	`CREATE EVENT TRIGGER despite_ddl_command ON ddl_command_end EXECUTE PROCEDURE despite.log_ddl_command()`,
+	`DROP EVENT TRIGGER IF EXISTS despite_dropped_object`,
+	`CREATE EVENT TRIGGER despite_dropped_object ON sql_drop EXECUTE PROCEDURE despite.log_dropped_object()`,
+}
+
+// ddlAuditUninstall removes everything ddlAuditInstall created, including
+// the recorded history. The schema is kept if anything else lives in it.
+var ddlAuditUninstall = []string{
+	`DROP EVENT TRIGGER IF EXISTS despite_ddl_command`,
+	`DROP EVENT TRIGGER IF EXISTS despite_dropped_object`,
+	`DROP TABLE IF EXISTS despite.ddl_log`,
+	`DROP FUNCTION IF EXISTS despite.log_ddl_command()`,
+	`DROP FUNCTION IF EXISTS despite.log_dropped_object()`,
+	`DO $$
+  BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_depend d JOIN pg_namespace n ON n.oid = d.refobjid
+                    WHERE d.refclassid = 'pg_namespace'::regclass AND n.nspname = 'despite') THEN
+      DROP SCHEMA IF EXISTS despite;
+    END IF;
+  END
+  $$`,
+}
+
+// runInTransaction executes statements so that either all of them or none
+// take effect.
+func runInTransaction(db *sql.DB, statements []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, s := range statements {
+		if _, err := tx.Exec(s); err != nil {
+			return fmt.Errorf("%s: %s", shortQuery(s, 60), err)
+		}
+	}
+	return tx.Commit()
+}
+
+func ddlAudit(output io.Writer, action string) error {
+	var statements []string
+	switch action {
+	case "install":
+		statements = ddlAuditInstall
+	case "uninstall":
+		statements = ddlAuditUninstall
+	default:
+		return fmt.Errorf("unknown action %q, use install or uninstall", action)
+	}
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	version, err := serverVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < 90500 {
+		return fmt.Errorf("the DDL audit needs PostgreSQL 9.5 or later")
+	}
+	if err := runInTransaction(db, statements); err != nil {
+		return err
+	}
+	if action == "install" {
+		fmt.Fprintln(output, "DDL audit installed, see pg:ddl-history")
+	} else {
+		fmt.Fprintln(output, "DDL audit and its history removed")
+	}
+	return nil
+}
+
+func ddlAuditCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("usage: despite pg:ddl-audit install|uninstall", 1)
+	}
+	if err := ddlAudit(os.Stdout, ctx.Args().First()); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
+
+func ddlHistoryReport(since time.Duration) reportFunc {
+	return func() (*report, error) {
+		db, err := sql.Open("postgres", dburi)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		var installed bool
+		if err := db.QueryRow(`SELECT to_regclass('despite.ddl_log') IS NOT NULL`).Scan(&installed); err != nil {
+			return nil, err
+		}
+		if !installed {
+			return nil, fmt.Errorf("no DDL history is recorded, run pg:ddl-audit install first")
+		}
+		r, err := queryReport(db, `SELECT to_char(at, 'YYYY-MM-DD HH24:MI:SS TZ') AS "At", role AS "Role",
+    command_tag AS "Command", coalesce(object_identity, '') AS "Object",
+    left(regexp_replace(statement, '\s+', ' ', 'g'), 80) AS "Statement"
+  FROM despite.ddl_log
+  WHERE at > now() - $1::interval
+  ORDER BY at, id`, fmt.Sprintf("%d milliseconds", since/time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Rows) == 0 {
+			r.Notes = append(r.Notes, fmt.Sprintf("no schema changes in the last %s", since))
+		}
+		return r, nil
+	}
+}
+
+func ddlHistoryCmd(ctx *cli.Context) error {
+	return runReport(ctx, ddlHistoryReport(ctx.Duration("since")))
+}
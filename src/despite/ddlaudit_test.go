@@ -0,0 +1,34 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDDLAuditIsReversible(t *testing.T) {
+	created := regexp.MustCompile(`^CREATE (?:OR REPLACE )?(?:EVENT TRIGGER|FUNCTION|TABLE IF NOT EXISTS|SCHEMA IF NOT EXISTS|INDEX IF NOT EXISTS) (\S+?)(?:\(|\s|$)`)
+	dropped := make(map[string]bool)
+	for _, s := range ddlAuditUninstall {
+		if m := regexp.MustCompile(`^DROP \w+(?: TRIGGER)? IF EXISTS (\S+?)(?:\(|$)`).FindStringSubmatch(s); m != nil {
+			dropped[m[1]] = true
+		}
+	}
+	for i, s := range ddlAuditInstall {
+		if !strings.HasPrefix(s, "CREATE") {
+			continue
+		}
+		m := created.FindStringSubmatch(s)
+		if m == nil {
+			t.Errorf("%q cannot be run twice", shortQuery(s, 60))
+			continue
+		}
+		name := m[1]
+		if strings.HasPrefix(s, "CREATE EVENT TRIGGER") && ddlAuditInstall[i-1] != "DROP EVENT TRIGGER IF EXISTS "+name {
+			t.Errorf("event trigger %s is not dropped before it is created", name)
+		}
+		if !dropped[name] && name != "despite" && name != "ddl_log_at" {
+			t.Errorf("%s is not removed on uninstall", name)
+		}
+	}
+}
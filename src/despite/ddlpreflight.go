@@ -0,0 +1,215 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// lockHolder is a session holding or waiting for a lock on the table or
+// one of its indexes. Pid is 0 for prepared transactions, which are told
+// apart by Transaction and named by Gid. Their XactAge is the time since
+// they were prepared.
+type lockHolder struct {
+	Pid         int
+	Transaction string
+	Gid         string
+	User        string
+	Application string
+	State       string
+	Mode        string
+	Granted     bool
+	XactAge     time.Duration
+	Query       string
+}
+
+// session identifies the holder, which appears once per lock mode
+func (h lockHolder) session() string {
+	if h.Pid == 0 {
+		return h.Transaction
+	}
+	return strconv.Itoa(h.Pid)
+}
+
+// name is how notes refer to the holder
+func (h lockHolder) name() string {
+	if h.Pid == 0 {
+		return fmt.Sprintf("prepared transaction %q", h.Gid)
+	}
+	return fmt.Sprintf("pid %d", h.Pid)
+}
+
+// sessionHolders keeps the first row of each session, the one in the
+// oldest transaction given the order holders are read in
+func sessionHolders(holders []lockHolder) []lockHolder {
+	var sessions []lockHolder
+	seen := make(map[string]bool)
+	for _, h := range holders {
+		if !seen[h.session()] {
+			seen[h.session()] = true
+			sessions = append(sessions, h)
+		}
+	}
+	return sessions
+}
+
+// preflightVerdict explains whether an ACCESS EXCLUSIVE lock, which
+// conflicts with every other lock mode, would be granted right away.
+// Sessions already waiting count too, since a new request queues behind them.
+func preflightVerdict(table string, holders []lockHolder) (string, bool) {
+	if len(holders) == 0 {
+		return fmt.Sprintf("an ACCESS EXCLUSIVE lock on %s would be granted immediately", table), false
+	}
+	sessions := sessionHolders(holders)
+	var oldest time.Duration
+	for _, h := range sessions {
+		if h.XactAge > oldest {
+			oldest = h.XactAge
+		}
+	}
+	return fmt.Sprintf("an ACCESS EXCLUSIVE lock on %s would queue behind %d sessions, the oldest in a transaction "+
+		"for %s, and every query on %s after it would queue too", table, len(sessions), oldest, table), true
+}
+
+func readLockHolders(db *sql.DB, table string) ([]lockHolder, error) {
+	// prepared transactions hold locks with no pid, under a virtual
+	// transaction of -1/xid
+	rows, err := db.Query(`SELECT coalesce(a.pid, 0), l.virtualtransaction, coalesce(p.gid, ''),
+    coalesce(a.usename::text, p.owner::text, ''), coalesce(a.application_name, ''),
+    CASE WHEN l.pid IS NULL THEN 'prepared' ELSE coalesce(a.state, '') END,
+    l.mode, l.granted,
+    coalesce(extract(epoch FROM now() - coalesce(a.xact_start, p.prepared)), 0), coalesce(a.query, '')
+  FROM pg_locks l
+    LEFT JOIN pg_stat_activity a ON a.pid = l.pid
+    LEFT JOIN pg_prepared_xacts p ON l.pid IS NULL
+      AND p.transaction::text = split_part(l.virtualtransaction, '/', 2)
+  WHERE l.locktype = 'relation'
+    AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+    AND (l.relation = $1::regclass
+      OR l.relation IN (SELECT indexrelid FROM pg_index WHERE indrelid = $1::regclass))
+    AND l.pid IS DISTINCT FROM pg_backend_pid()
+  ORDER BY coalesce(a.xact_start, p.prepared) NULLS FIRST`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var holders []lockHolder
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var h lockHolder
+		var age float64
+		err := rows.Scan(&h.Pid, &h.Transaction, &h.Gid, &h.User, &h.Application, &h.State, &h.Mode, &h.Granted, &age, &h.Query)
+		if err != nil {
+			return nil, err
+		}
+		// a session usually locks the table and each of its indexes
+		key := fmt.Sprintf("%s %s %t", h.session(), h.Mode, h.Granted)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		h.XactAge = time.Duration(age * float64(time.Second))
+		holders = append(holders, h)
+	}
+	return holders, rows.Err()
+}
+
+// tryLock takes and immediately releases an ACCESS EXCLUSIVE lock,
+// failing at once instead of queueing if it cannot be granted.
+func tryLock(db *sql.DB, table string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var name string
+	if err := tx.QueryRow(`SELECT $1::regclass::text`, table).Scan(&name); err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("LOCK TABLE %s IN ACCESS EXCLUSIVE MODE NOWAIT", name))
+	return err
+}
+
+// ddlPreflight reports what DDL on table would have to wait for and
+// returns true if it would queue.
+func ddlPreflight(output io.Writer, table string, olderThan time.Duration, try bool) (bool, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	var exists bool
+	if err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, fmt.Errorf("table %s does not exist", table)
+	}
+	holders, err := readLockHolders(db, table)
+	if err != nil {
+		return false, err
+	}
+	if len(holders) > 0 {
+		r := &report{Header: []string{"Pid", "User", "Application", "State", "Mode", "Granted", "InTransaction", "Query"}}
+		for _, h := range holders {
+			pid := strconv.Itoa(h.Pid)
+			if h.Pid == 0 {
+				pid = h.Gid
+			}
+			r.Append([]string{pid, h.User, h.Application, h.State, h.Mode,
+				strconv.FormatBool(h.Granted), h.XactAge.Round(time.Second).String(), shortQuery(h.Query, 60)})
+		}
+		for _, h := range sessionHolders(holders) {
+			if h.XactAge > olderThan {
+				r.Notes = append(r.Notes, fmt.Sprintf("%s has been in a transaction for %s, longer than %s",
+					h.name(), h.XactAge.Round(time.Second), olderThan))
+			}
+		}
+		renderReport(output, r)
+		fmt.Fprintln(output)
+	}
+	verdict, queues := preflightVerdict(table, holders)
+	fmt.Fprintln(output, verdict)
+	if try {
+		if err := tryLock(db, table); err != nil {
+			fmt.Fprintf(output, "LOCK TABLE NOWAIT failed: %s\n", err)
+			queues = true
+		} else {
+			fmt.Fprintln(output, "LOCK TABLE NOWAIT succeeded and was rolled back")
+		}
+	}
+	return queues, nil
+}
+
+func ddlPreflightCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("usage: despite pg:ddl-preflight TABLE", 1)
+	}
+	queues, err := ddlPreflight(os.Stdout, ctx.Args().First(), ctx.Duration("older-than"), ctx.Bool("try"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	if queues {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreflightVerdict(t *testing.T) {
+	if verdict, queues := preflightVerdict("orders", nil); queues || !strings.Contains(verdict, "granted immediately") {
+		t.Errorf("expected the lock to be granted, got %q", verdict)
+	}
+	holders := []lockHolder{
+		{Pid: 10, Mode: "AccessShareLock", Granted: true, XactAge: 2 * time.Hour},
+		{Pid: 11, Mode: "RowExclusiveLock", Granted: false, XactAge: time.Second},
+	}
+	verdict, queues := preflightVerdict("orders", holders)
+	if !queues || !strings.Contains(verdict, "queue behind 2 sessions") || !strings.Contains(verdict, "2h0m0s") {
+		t.Errorf("expected the lock to queue behind both sessions, got %q", verdict)
+	}
+}
+
+func TestPreflightVerdictCountsSessions(t *testing.T) {
+	holders := []lockHolder{
+		{Pid: 10, Mode: "AccessShareLock", Granted: true, XactAge: time.Hour},
+		{Pid: 10, Mode: "RowExclusiveLock", Granted: true, XactAge: time.Hour},
+		{Pid: 0, Transaction: "-1/1234", Mode: "RowExclusiveLock", Granted: true},
+		{Pid: 0, Transaction: "-1/1235", Mode: "RowExclusiveLock", Granted: true},
+	}
+	if verdict, _ := preflightVerdict("orders", holders); !strings.Contains(verdict, "queue behind 3 sessions") {
+		t.Errorf("expected pid 10 to count once, got %q", verdict)
+	}
+}
+
+func TestPreflightPreparedTransaction(t *testing.T) {
+	holders := []lockHolder{
+		{Pid: 0, Transaction: "-1/1234", Gid: "orphan", Mode: "RowExclusiveLock", Granted: true, XactAge: 72 * time.Hour},
+		{Pid: 10, Mode: "AccessShareLock", Granted: true, XactAge: time.Minute},
+	}
+	if verdict, _ := preflightVerdict("orders", holders); !strings.Contains(verdict, "72h0m0s") {
+		t.Errorf("expected the prepared transaction to be the oldest, got %q", verdict)
+	}
+	if name := holders[0].name(); name != `prepared transaction "orphan"` {
+		t.Errorf("prepared transaction is named %s", name)
+	}
+	if name := holders[1].name(); name != "pid 10" {
+		t.Errorf("session is named %s", name)
+	}
+}
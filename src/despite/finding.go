@@ -0,0 +1,62 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sort"
+
+// severity ranks audit findings, most severe last so they sort naturally
+type severity int
+
+const (
+	severityInfo severity = iota
+	severityLow
+	severityMedium
+	severityHigh
+	severityCritical
+)
+
+func (s severity) String() string {
+	switch s {
+	case severityCritical:
+		return "CRITICAL"
+	case severityHigh:
+		return "HIGH"
+	case severityMedium:
+		return "MEDIUM"
+	case severityLow:
+		return "LOW"
+	}
+	return "INFO"
+}
+
+// finding is one problem reported by an audit command
+type finding struct {
+	Severity severity
+	Subject  string
+	Message  string
+}
+
+// findingsReport sorts findings by severity, most severe first, keeping
+// the order the audit produced them in within a severity.
+func findingsReport(subject string, findings []finding) *report {
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+	r := &report{Header: []string{"Severity", subject, "Finding"}, Key: []int{1, 2}}
+	for _, f := range findings {
+		r.Append([]string{f.Severity.String(), f.Subject, f.Message})
+	}
+	return r
+}
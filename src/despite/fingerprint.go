@@ -0,0 +1,135 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+var (
+	placeholderList = regexp.MustCompile(`\(\?(?:, \?)+\)`)
+	arrayList       = regexp.MustCompile(`\[\?(?:, \?)+\]`)
+	spaceAroundList = regexp.MustCompile(`\s*,\s*`)
+	spaceInParens   = regexp.MustCompile(`\(\s+|\s+\)`)
+)
+
+// normalizeQuery reduces a query to its shape, so that executions with
+// different constants compare equal: comments are dropped, string and
+// numeric literals and $n parameters become ?, lists of them collapse to
+// a single ?, keywords and identifiers are lowercased except where quoted,
+// and whitespace is collapsed.
+func normalizeQuery(query string) string {
+	var out bytes.Buffer
+	identChar := func(c byte) bool {
+		return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+	}
+	last := func() byte {
+		b := out.Bytes()
+		if len(b) == 0 {
+			return ' '
+		}
+		return b[len(b)-1]
+	}
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			i += end - 1
+			out.WriteByte(' ')
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 4
+			}
+			i += end + 3
+			out.WriteByte(' ')
+		case c == '\'':
+			// E'...' and B'...' prefixes belong to the literal
+			if b := out.Bytes(); len(b) > 0 && strings.IndexByte("eEbBxXnN", last()) >= 0 &&
+				(len(b) == 1 || !identChar(b[len(b)-2])) {
+				out.Truncate(len(b) - 1)
+			}
+			for i++; i < len(query); i++ {
+				if query[i] == '\\' && i+1 < len(query) {
+					i++
+				} else if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			out.WriteByte('?')
+		case c == '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				end = len(query) - i - 2
+			}
+			out.WriteString(query[i : i+end+2])
+			i += end + 1
+		case c == '$' && !identChar(last()) && dollarQuote.MatchString(query[i:]):
+			tag := dollarQuote.FindString(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				end = len(query) - i - 2*len(tag)
+			}
+			i += end + 2*len(tag) - 1
+			out.WriteByte('?')
+		case c == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' && !identChar(last()):
+			for i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+				i++
+			}
+			out.WriteByte('?')
+		case c >= '0' && c <= '9' && !identChar(last()) && last() != '.':
+			for i+1 < len(query) && (identChar(query[i+1]) || query[i+1] == '.' ||
+				(query[i+1] == '-' || query[i+1] == '+') && (query[i] == 'e' || query[i] == 'E')) {
+				i++
+			}
+			if last() == '-' {
+				// a negative number, unless the minus is a binary operator
+				b := bytes.TrimRight(out.Bytes()[:out.Len()-1], " ")
+				if len(b) == 0 || strings.IndexByte("(,=<>+-*/", b[len(b)-1]) >= 0 {
+					out.Truncate(out.Len() - 1)
+				}
+			}
+			out.WriteByte('?')
+		case c >= 'A' && c <= 'Z':
+			out.WriteByte(c + 'a' - 'A')
+		default:
+			out.WriteByte(c)
+		}
+	}
+	normalized := strings.Join(strings.Fields(out.String()), " ")
+	normalized = spaceAroundList.ReplaceAllString(normalized, ", ")
+	normalized = spaceInParens.ReplaceAllStringFunc(normalized, strings.TrimSpace)
+	normalized = placeholderList.ReplaceAllString(normalized, "(?)")
+	normalized = arrayList.ReplaceAllString(normalized, "[?]")
+	return strings.TrimRight(normalized, "; ")
+}
+
+// queryFingerprint identifies the normalized form of a query
+func queryFingerprint(query string) string {
+	sum := sha1.Sum([]byte(normalizeQuery(query)))
+	return hex.EncodeToString(sum[:])[:12]
+}
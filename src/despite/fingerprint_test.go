@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestNormalizeQuery(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM orders WHERE id = 42":                              "select * from orders where id = ?",
+		"select *\n  from ORDERS where id=-7 -- by id\n":                  "select * from orders where id=?",
+		"SELECT a - 1 FROM t WHERE b IN (1, 2,3) AND c = ANY($1)":         "select a - ? from t where b in (?) and c = any(?)",
+		`SELECT "Name" FROM t WHERE s = 'it''s' AND e = E'a\'b' /**/;`:    `select "Name" from t where s = ? and e = ?`,
+		"SELECT x FROM t2 WHERE y = ARRAY[1.5, 2e-3] AND z = $tag$;$tag$": "select x from t2 where y = array[?] and z = ?",
+	}
+	for query, expected := range cases {
+		if normalized := normalizeQuery(query); normalized != expected {
+			t.Errorf("normalizeQuery(%q) is %q, expected %q", query, normalized, expected)
+		}
+	}
+	if queryFingerprint("SELECT 1 FROM t WHERE id IN (1, 2)") != queryFingerprint("select 1 from t where id in (3,4,5,6)") {
+		t.Errorf("queries differing only in constants should share a fingerprint")
+	}
+}
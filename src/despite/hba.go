@@ -0,0 +1,277 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/urfave/cli"
+)
+
+// hbaRule is one line of pg_hba.conf as parsed by the server
+type hbaRule struct {
+	Line      int
+	Type      string
+	Databases []string
+	Users     []string
+	Address   string
+	Netmask   string
+	Method    string
+	Error     string
+}
+
+// network returns the rule's address range, or nil for local rules and
+// addresses we cannot reason about such as hostnames or samenet.
+func (r hbaRule) network() *net.IPNet {
+	switch r.Address {
+	case "all":
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	case "":
+		return nil
+	}
+	ip := net.ParseIP(r.Address)
+	if ip == nil {
+		return nil
+	}
+	if r.Netmask == "" {
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	mask := net.ParseIP(r.Netmask)
+	if mask == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.IPMask(mask.To4())}
+	}
+	return &net.IPNet{IP: ip, Mask: net.IPMask(mask.To16())}
+}
+
+// openToWorld is true for rules that accept any IPv4 or IPv6 address
+func (r hbaRule) openToWorld() bool {
+	n := r.network()
+	if n == nil {
+		return false
+	}
+	ones, _ := n.Mask.Size()
+	return ones == 0
+}
+
+// loopback is true for rules that only accept connections from the
+// server's own host over TCP
+func (r hbaRule) loopback() bool {
+	if r.Address == "localhost" {
+		return true
+	}
+	n := r.network()
+	if n == nil || !n.IP.IsLoopback() {
+		return false
+	}
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		return ones >= 8
+	}
+	return ones == 128
+}
+
+// covers reports whether every connection matching later also matches r,
+// meaning later can never be used.
+func (r hbaRule) covers(later hbaRule) bool {
+	if r.Error != "" || later.Error != "" {
+		return false
+	}
+	switch {
+	case r.Type == later.Type:
+	case r.Type == "host" && (later.Type == "hostssl" || later.Type == "hostnossl" ||
+		later.Type == "hostgssenc" || later.Type == "hostnogssenc"):
+	default:
+		return false
+	}
+	if !coversDatabases(r.Databases, later.Databases) || !coversNames(r.Users, later.Users) {
+		return false
+	}
+	if r.Type == "local" {
+		return true
+	}
+	outer, inner := r.network(), later.network()
+	if outer == nil || inner == nil {
+		return false
+	}
+	// all is the only address matching both IPv4 and IPv6
+	if r.Address == "all" {
+		return true
+	}
+	innerOnes, innerBits := inner.Mask.Size()
+	outerOnes, outerBits := outer.Mask.Size()
+	if innerBits != outerBits {
+		return false
+	}
+	return outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// coversDatabases is coversNames for the database column, where all does
+// not match replication connections and only replication does
+func coversDatabases(outer, inner []string) bool {
+	if hasName(inner, "replication") && !hasName(outer, "replication") {
+		return false
+	}
+	return coversNames(outer, inner)
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func coversNames(outer, inner []string) bool {
+	for _, o := range outer {
+		if o == "all" {
+			return true
+		}
+	}
+	for _, i := range inner {
+		found := false
+		for _, o := range outer {
+			if i == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(inner) > 0
+}
+
+func hasAll(names []string) bool {
+	for _, n := range names {
+		if n == "all" {
+			return true
+		}
+	}
+	return false
+}
+
+// hbaFindings flags risky rules. Rules are checked in file order because
+// the server uses the first rule that matches a connection.
+func hbaFindings(rules []hbaRule) []finding {
+	var findings []finding
+	for i, r := range rules {
+		subject := fmt.Sprintf("line %d", r.Line)
+		add := func(s severity, format string, args ...interface{}) {
+			findings = append(findings, finding{s, subject, fmt.Sprintf(format, args...)})
+		}
+		if r.Error != "" {
+			add(severityHigh, "could not be parsed and is ignored: %s", r.Error)
+			continue
+		}
+		remote := r.Type != "local" && !r.loopback()
+		switch {
+		case r.Method == "trust" && remote:
+			add(severityCritical, "trust authentication for %s connections from %s, no password needed", r.Type, r.Address)
+		case r.Method == "trust" && r.Type == "local":
+			add(severityMedium, "trust authentication for local connections, any local OS user can connect as any role")
+		case r.Method == "trust":
+			add(severityMedium, "trust authentication for %s connections from loopback %s, any local OS user can connect as any role",
+				r.Type, r.Address)
+		case r.Method == "password" && remote && r.Type != "hostssl":
+			add(severityHigh, "password authentication sends passwords in clear text over %s connections", r.Type)
+		case r.Method == "password" && remote:
+			add(severityMedium, "password authentication sends passwords to the server, prefer scram-sha-256")
+		case r.Method == "md5" && remote:
+			add(severityMedium, "md5 authentication over the network, prefer scram-sha-256")
+		}
+		if r.Method != "reject" && r.openToWorld() {
+			add(severityHigh, "accepts %s connections from any address", r.Type)
+		}
+		if r.Method != "reject" && remote && hasAll(r.Databases) && hasAll(r.Users) {
+			add(severityMedium, "matches all databases and all users")
+		}
+		for _, earlier := range rules[:i] {
+			if earlier.covers(r) {
+				add(severityLow, "can never match, it is shadowed by line %d", earlier.Line)
+				break
+			}
+		}
+	}
+	return findings
+}
+
+func readHBARules(db *sql.DB) ([]hbaRule, error) {
+	rows, err := db.Query(`SELECT line_number, coalesce(type, ''),
+    coalesce(to_json(database)::text, '[]'), coalesce(to_json(user_name)::text, '[]'),
+    coalesce(address, ''), coalesce(netmask, ''), coalesce(auth_method, ''), coalesce(error, '')
+  FROM pg_hba_file_rules
+  ORDER BY line_number`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []hbaRule
+	for rows.Next() {
+		var r hbaRule
+		var databases, users string
+		err := rows.Scan(&r.Line, &r.Type, &databases, &users, &r.Address, &r.Netmask, &r.Method, &r.Error)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(databases), &r.Databases); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(users), &r.Users); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func hbaReport() (*report, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version < 100000 {
+		return nil, fmt.Errorf("pg_hba_file_rules needs PostgreSQL 10 or later")
+	}
+	rules, err := readHBARules(db)
+	if err != nil {
+		return nil, err
+	}
+	r := findingsReport("Rule", hbaFindings(rules))
+	r.Notes = append(r.Notes, fmt.Sprintf("checked %d rules as currently written in pg_hba.conf, "+
+		"which may differ from what the server loaded if it has not been reloaded", len(rules)))
+	return r, nil
+}
+
+func hbaCmd(ctx *cli.Context) error {
+	return runReport(ctx, hbaReport)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHBAFindings(t *testing.T) {
+	all := []string{"all"}
+	rules := []hbaRule{
+		{Line: 1, Type: "local", Databases: all, Users: all, Method: "peer"},
+		{Line: 2, Type: "host", Databases: all, Users: all, Address: "10.0.0.0", Netmask: "255.0.0.0", Method: "scram-sha-256"},
+		{Line: 3, Type: "hostssl", Databases: []string{"app"}, Users: []string{"app"}, Address: "10.1.0.0", Netmask: "255.255.0.0", Method: "md5"},
+		{Line: 4, Type: "host", Databases: []string{"app"}, Users: all, Address: "0.0.0.0", Netmask: "0.0.0.0", Method: "trust"},
+		{Line: 5, Type: "host", Error: "invalid authentication method \"pasword\""},
+	}
+	expected := []finding{
+		{severityMedium, "line 2", "matches all databases and all users"},
+		{severityMedium, "line 3", "md5 authentication over the network, prefer scram-sha-256"},
+		{severityLow, "line 3", "can never match, it is shadowed by line 2"},
+		{severityCritical, "line 4", "trust authentication for host connections from 0.0.0.0, no password needed"},
+		{severityHigh, "line 4", "accepts host connections from any address"},
+		{severityHigh, "line 5", "could not be parsed and is ignored: invalid authentication method \"pasword\""},
+	}
+	if findings := hbaFindings(rules); !reflect.DeepEqual(findings, expected) {
+		t.Errorf("findings are:\n%v\nexpected:\n%v", findings, expected)
+	}
+}
+
+// TestHBAFindingsStockFile checks the pg_hba.conf initdb writes with
+// --auth=trust, whose replication and IPv6 lines are not shadowed
+func TestHBAFindingsStockFile(t *testing.T) {
+	all := []string{"all"}
+	replication := []string{"replication"}
+	v4 := "255.255.255.255"
+	v6 := "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"
+	rules := []hbaRule{
+		{Line: 89, Type: "local", Databases: all, Users: all, Method: "trust"},
+		{Line: 91, Type: "host", Databases: all, Users: all, Address: "127.0.0.1", Netmask: v4, Method: "trust"},
+		{Line: 93, Type: "host", Databases: all, Users: all, Address: "::1", Netmask: v6, Method: "trust"},
+		{Line: 96, Type: "local", Databases: replication, Users: all, Method: "trust"},
+		{Line: 97, Type: "host", Databases: replication, Users: all, Address: "127.0.0.1", Netmask: v4, Method: "md5"},
+		{Line: 98, Type: "host", Databases: replication, Users: all, Address: "::1", Netmask: v6, Method: "scram-sha-256"},
+	}
+	local := "trust authentication for local connections, any local OS user can connect as any role"
+	expected := []finding{
+		{severityMedium, "line 89", local},
+		{severityMedium, "line 91", "trust authentication for host connections from loopback 127.0.0.1, any local OS user can connect as any role"},
+		{severityMedium, "line 93", "trust authentication for host connections from loopback ::1, any local OS user can connect as any role"},
+		{severityMedium, "line 96", local},
+	}
+	if findings := hbaFindings(rules); !reflect.DeepEqual(findings, expected) {
+		t.Errorf("findings are:\n%v\nexpected:\n%v", findings, expected)
+	}
+}
+
+func TestHBACoversAddressFamily(t *testing.T) {
+	all := []string{"all"}
+	anyV4 := hbaRule{Type: "host", Databases: all, Users: all, Address: "0.0.0.0", Netmask: "0.0.0.0", Method: "md5"}
+	v6 := hbaRule{Type: "host", Databases: all, Users: all, Address: "::1", Netmask: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", Method: "md5"}
+	v4 := hbaRule{Type: "host", Databases: all, Users: all, Address: "10.0.0.1", Netmask: "255.255.255.255", Method: "md5"}
+	anyAddress := hbaRule{Type: "host", Databases: all, Users: all, Address: "all", Method: "md5"}
+	if anyV4.covers(v6) {
+		t.Error("0.0.0.0/0 should not cover ::1/128")
+	}
+	if !anyV4.covers(v4) {
+		t.Error("0.0.0.0/0 should cover 10.0.0.1/32")
+	}
+	if !anyAddress.covers(v6) || !anyAddress.covers(v4) {
+		t.Error("all should cover every address")
+	}
+}
@@ -0,0 +1,404 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// heartbeatInstall creates the table beats are written to, on the primary
+// and on any logical subscriber
+var heartbeatInstall = []string{
+	`CREATE SCHEMA IF NOT EXISTS despite`,
+	`CREATE TABLE IF NOT EXISTS despite.heartbeat (
+    source text PRIMARY KEY,
+    beat timestamptz NOT NULL
+  )`,
+}
+
+// heartbeatPublication publishes the heartbeat table for logical
+// subscribers, whose subscription must include it
+const heartbeatPublication = `DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = 'despite_heartbeat') THEN
+    CREATE PUBLICATION despite_heartbeat FOR TABLE despite.heartbeat;
+  END IF;
+END
+$$`
+
+// heartbeatClock relates the primary's clock to ours, so lag on a standby
+// is measured without trusting the standby's clock. Offset is what to add
+// to a local time to get the primary's time, and is off by at most half
+// the round trip of the write.
+type heartbeatClock struct {
+	Offset time.Duration
+}
+
+func (c heartbeatClock) lag(readAt, beat time.Time) time.Duration {
+	lag := readAt.Add(c.Offset).Sub(beat)
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
+// writeBeat records the primary's current time and returns it with the
+// clock relation measured while doing so.
+func writeBeat(db *sql.DB, source string) (time.Time, heartbeatClock, error) {
+	sent := time.Now()
+	var beat time.Time
+	err := db.QueryRow(`INSERT INTO despite.heartbeat (source, beat) VALUES ($1, clock_timestamp())
+  ON CONFLICT (source) DO UPDATE SET beat = excluded.beat
+  RETURNING beat`, source).Scan(&beat)
+	if err != nil {
+		return beat, heartbeatClock{}, err
+	}
+	received := time.Now()
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	return beat, heartbeatClock{Offset: beat.Sub(midpoint)}, nil
+}
+
+// readBeat returns the newest beat visible on a standby, or the zero time
+// when none has arrived yet.
+func readBeat(db *sql.DB, source string) (time.Time, error) {
+	var beat time.Time
+	err := db.QueryRow(`SELECT beat FROM despite.heartbeat WHERE source = $1`, source).Scan(&beat)
+	if err == sql.ErrNoRows {
+		return beat, nil
+	}
+	return beat, err
+}
+
+// beatLog is what has been written to the primary, shared between the
+// writer and the standby pollers
+type beatLog struct {
+	mu     sync.Mutex
+	clock  heartbeatClock
+	writes []time.Time
+}
+
+const maxBeatLog = 1000
+
+func (l *beatLog) written(beat time.Time, clock heartbeatClock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = clock
+	l.writes = append(l.writes, beat)
+	if len(l.writes) > maxBeatLog {
+		l.writes = l.writes[len(l.writes)-maxBeatLog:]
+	}
+}
+
+func (l *beatLog) currentClock() heartbeatClock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clock
+}
+
+// behind is how long ago, by the primary's clock, the oldest beat newer
+// than seen was written. It is zero when seen is the newest beat.
+func (l *beatLog) behind(seen, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, w := range l.writes {
+		if w.After(seen) {
+			return l.clock.lag(now, w)
+		}
+	}
+	return 0
+}
+
+// beatWatcher follows the heartbeat on one standby. A beat's lag is
+// measured when it is first seen, so standbys are polled several times per
+// beat written and the lag is accurate to about the poll interval.
+type beatWatcher struct {
+	mu      sync.Mutex
+	seen    time.Time
+	lastLag time.Duration
+	summary lagSummary
+}
+
+// newBeatWatcher starts from the beat the standby already has, which an
+// earlier run with the same source left behind and is not a sample
+func newBeatWatcher(current time.Time) *beatWatcher {
+	return &beatWatcher{seen: current}
+}
+
+// observe records the lag of beat if it is newer than any seen before. A
+// stale read, returning a beat already seen, only says the next one has not
+// arrived yet and is not a sample.
+func (w *beatWatcher) observe(beat, seenAt time.Time, clock heartbeatClock) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !beat.After(w.seen) {
+		return false
+	}
+	w.seen = beat
+	w.lastLag = clock.lag(seenAt, beat)
+	w.summary.add(w.lastLag)
+	return true
+}
+
+func (w *beatWatcher) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.summary.fail(err)
+}
+
+// status is the last lag measured, or how long the standby has been
+// waiting for the next beat if that is longer
+func (w *beatWatcher) status(l *beatLog, now time.Time) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if waiting := l.behind(w.seen, now); waiting > w.lastLag {
+		return ">" + waiting.Round(time.Millisecond).String()
+	}
+	return w.summary.last
+}
+
+// poll reads the beat from standby every interval until done is closed
+func (w *beatWatcher) poll(standby *sql.DB, source string, l *beatLog, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		sent := time.Now()
+		beat, err := readBeat(standby, source)
+		if err != nil {
+			w.fail(err)
+			continue
+		}
+		received := time.Now()
+		w.observe(beat, sent.Add(received.Sub(sent)/2), l.currentClock())
+	}
+}
+
+// lagSummary is the distribution of lag seen on one standby
+type lagSummary struct {
+	samples []time.Duration
+	errors  int
+	last    string
+}
+
+func (s *lagSummary) add(lag time.Duration) {
+	s.samples = append(s.samples, lag)
+	s.last = lag.Round(time.Millisecond).String()
+}
+
+func (s *lagSummary) fail(err error) {
+	s.errors++
+	s.last = err.Error()
+}
+
+// percentile returns the p-th percentile of the samples by nearest rank
+func (s *lagSummary) percentile(p float64) time.Duration {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), s.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func heartbeatSummary(labels []string, summaries []*lagSummary) *report {
+	r := &report{Header: []string{"Standby", "Samples", "Errors", "Min", "P50", "P95", "Max", "Last"}}
+	for i, s := range summaries {
+		row := []string{labels[i], strconv.Itoa(len(s.samples)), strconv.Itoa(s.errors)}
+		for _, p := range []float64{0, 50, 95, 100} {
+			value := ""
+			if len(s.samples) > 0 {
+				value = s.percentile(p).Round(time.Millisecond).String()
+			}
+			row = append(row, value)
+		}
+		r.Append(append(row, s.last))
+	}
+	return r
+}
+
+type heartbeatOptions struct {
+	Standbys []string
+	Source   string
+	Interval time.Duration
+	Duration time.Duration
+}
+
+// pollInterval is how often standbys are read, a tenth of the interval
+// between beats
+func (o heartbeatOptions) pollInterval() time.Duration {
+	poll := o.Interval / 10
+	if poll < 10*time.Millisecond {
+		poll = 10 * time.Millisecond
+	}
+	return poll
+}
+
+func heartbeat(output io.Writer, opts heartbeatOptions) error {
+	primary, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer primary.Close()
+	if err := runInTransaction(primary, heartbeatInstall); err != nil {
+		return err
+	}
+	beats := &beatLog{}
+	labels := make([]string, len(opts.Standbys))
+	standbys := make([]*sql.DB, len(opts.Standbys))
+	watchers := make([]*beatWatcher, len(opts.Standbys))
+	var subscribers []string
+	for i, uri := range opts.Standbys {
+		labels[i] = clusterLabel(uri, i)
+		if standbys[i], err = sql.Open("postgres", uri); err != nil {
+			return fmt.Errorf("%s: %s", labels[i], err)
+		}
+		defer standbys[i].Close()
+		standbys[i].SetMaxOpenConns(1)
+		var recovery bool
+		if err := standbys[i].QueryRow(`SELECT pg_is_in_recovery()`).Scan(&recovery); err != nil {
+			return fmt.Errorf("%s: %s", labels[i], err)
+		}
+		// a server that is not in recovery can only receive beats through
+		// logical replication, into a table of its own
+		if !recovery {
+			if err := runInTransaction(standbys[i], heartbeatInstall); err != nil {
+				return fmt.Errorf("%s: %s", labels[i], err)
+			}
+			subscribers = append(subscribers, labels[i])
+		}
+		current, err := readBeat(standbys[i], opts.Source)
+		if err != nil {
+			return fmt.Errorf("%s: %s", labels[i], err)
+		}
+		watchers[i] = newBeatWatcher(current)
+	}
+	if len(subscribers) > 0 {
+		version, err := serverVersion(primary)
+		if err != nil {
+			return err
+		}
+		if version < 100000 {
+			return fmt.Errorf("%s are not standbys, and logical replication needs PostgreSQL 10 or later",
+				strings.Join(subscribers, ", "))
+		}
+		if err := runInTransaction(primary, []string{heartbeatPublication}); err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "%s are logical subscribers, beats arrive once a subscription there "+
+			"includes the publication despite_heartbeat\n\n", strings.Join(subscribers, ", "))
+	}
+	// stop the pollers before the standby connections are closed
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+	for i, w := range watchers {
+		wg.Add(1)
+		go func(w *beatWatcher, standby *sql.DB) {
+			defer wg.Done()
+			w.poll(standby, opts.Source, beats, opts.pollInterval(), done)
+		}(w, standbys[i])
+	}
+	fmt.Fprintf(output, "%-8s  %s\n", "time", strings.Join(labels, "  "))
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	if opts.Duration > 0 {
+		deadline = time.After(opts.Duration)
+	}
+	summarize := func() {
+		fmt.Fprintln(output)
+		// the pollers are still running, so read through their locks
+		rows := make([]*lagSummary, len(watchers))
+		for i, w := range watchers {
+			w.mu.Lock()
+			copied := w.summary
+			w.mu.Unlock()
+			rows[i] = &copied
+		}
+		renderReport(output, heartbeatSummary(labels, rows))
+	}
+	for first := true; ; first = false {
+		// report on the previous beat, which the standbys have had a whole
+		// interval to receive, before writing the next
+		if !first {
+			columns := make([]string, len(watchers))
+			for i, w := range watchers {
+				columns[i] = fmt.Sprintf("%-*s", len(labels[i]), w.status(beats, time.Now()))
+			}
+			fmt.Fprintf(output, "%s  %s\n", time.Now().Format("15:04:05"), strings.Join(columns, "  "))
+		}
+		beat, clock, err := writeBeat(primary, opts.Source)
+		if err != nil {
+			fmt.Fprintf(output, "%s  primary: %s\n", time.Now().Format("15:04:05"), err)
+		} else {
+			beats.written(beat, clock)
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			summarize()
+			return nil
+		case <-stop:
+			summarize()
+			return nil
+		}
+	}
+}
+func heartbeatCmd(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return cli.NewExitError("usage: despite --dburi PRIMARY_URI pg:heartbeat STANDBY_URI...", 1)
+	}
+	source := ctx.String("source")
+	if source == "" {
+		source, _ = os.Hostname()
+	}
+	opts := heartbeatOptions{
+		Standbys: ctx.Args(),
+		Source:   source,
+		Interval: ctx.Duration("interval"),
+		Duration: ctx.Duration("duration"),
+	}
+	if err := heartbeat(os.Stdout, opts); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatClockLag(t *testing.T) {
+	beat := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	// our clock runs 2s behind the primary's
+	clock := heartbeatClock{Offset: 2 * time.Second}
+	if lag := clock.lag(beat.Add(-500*time.Millisecond), beat); lag != 1500*time.Millisecond {
+		t.Errorf("lag is %s, expected 1.5s", lag)
+	}
+	if lag := clock.lag(beat.Add(-5*time.Second), beat); lag != 0 {
+		t.Errorf("lag is %s, expected it to be clamped to 0", lag)
+	}
+}
+
+func TestHeartbeatSummary(t *testing.T) {
+	s := &lagSummary{}
+	for _, ms := range []int{40, 10, 30, 20, 1000} {
+		s.add(time.Duration(ms) * time.Millisecond)
+	}
+	s.fail(errors.New("connection refused"))
+	r := heartbeatSummary([]string{"replica1:5432/postgres"}, []*lagSummary{s})
+	expected := [][]string{{"replica1:5432/postgres", "5", "1", "10ms", "30ms", "1s", "1s", "connection refused"}}
+	if !reflect.DeepEqual(r.Rows, expected) {
+		t.Errorf("summary is %q, expected %q", r.Rows, expected)
+	}
+}
+
+func TestBeatWatcherStaleRead(t *testing.T) {
+	beat := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := heartbeatClock{}
+	w := &beatWatcher{}
+	if !w.observe(beat, beat.Add(50*time.Millisecond), clock) {
+		t.Fatal("first beat was not recorded")
+	}
+	// polled again before the next beat arrived: the same beat, much later
+	if w.observe(beat, beat.Add(900*time.Millisecond), clock) {
+		t.Error("a stale read was recorded as a sample")
+	}
+	next := beat.Add(time.Second)
+	w.observe(next, next.Add(30*time.Millisecond), clock)
+	expected := []time.Duration{50 * time.Millisecond, 30 * time.Millisecond}
+	if !reflect.DeepEqual(w.summary.samples, expected) {
+		t.Errorf("samples are %v, expected %v", w.summary.samples, expected)
+	}
+}
+
+func TestBeatWatcherStatusWhileWaiting(t *testing.T) {
+	beat := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	beats := &beatLog{}
+	w := &beatWatcher{}
+	beats.written(beat, heartbeatClock{})
+	w.observe(beat, beat.Add(20*time.Millisecond), heartbeatClock{})
+	if status := w.status(beats, beat.Add(time.Second)); status != "20ms" {
+		t.Errorf("status is %q, expected 20ms", status)
+	}
+	// the next beat has not arrived after 1.5s
+	beats.written(beat.Add(time.Second), heartbeatClock{})
+	beats.written(beat.Add(2*time.Second), heartbeatClock{})
+	if status := w.status(beats, beat.Add(2500*time.Millisecond)); status != ">1.5s" {
+		t.Errorf("status is %q, expected >1.5s", status)
+	}
+}
+
+func TestBeatWatcherIgnoresPreviousRun(t *testing.T) {
+	// the row an earlier run left behind, hours before this one started
+	previous := time.Date(2016, 1, 1, 9, 0, 0, 0, time.UTC)
+	beat := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	w := newBeatWatcher(previous)
+	if w.observe(previous, beat, heartbeatClock{}) {
+		t.Error("the previous run's beat was recorded as a sample")
+	}
+	if !w.observe(beat, beat.Add(40*time.Millisecond), heartbeatClock{}) {
+		t.Fatal("the first beat of this run was not recorded")
+	}
+	expected := []time.Duration{40 * time.Millisecond}
+	if !reflect.DeepEqual(w.summary.samples, expected) {
+		t.Errorf("samples are %v, expected %v", w.summary.samples, expected)
+	}
+}
@@ -0,0 +1,512 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// maxIndexColumns keeps suggestions to indexes that stay cheap to maintain
+const maxIndexColumns = 3
+
+// columnPredicate is a column compared in a WHERE or JOIN condition.
+// Equality predicates can use any leading index columns, a range
+// predicate only the last one that is used.
+type columnPredicate struct {
+	Table    string
+	Column   string
+	Equality bool
+}
+
+var (
+	sqlIdent       = `(?:"[^"]+"|[A-Za-z_][\w$]*)`
+	fromPattern    = regexp.MustCompile(`(?i)\b(?:FROM|JOIN|UPDATE|INTO)\s+(` + sqlIdent + `(?:\.` + sqlIdent + `)?)(?:\s+(?:AS\s+)?(` + sqlIdent + `))?`)
+	regionStart    = regexp.MustCompile(`(?i)\b(?:WHERE|ON)\b`)
+	regionEnd      = regexp.MustCompile(`(?i)\b(?:WHERE|ON|GROUP BY|ORDER BY|LIMIT|OFFSET|HAVING|RETURNING|UNION|WINDOW|JOIN|LEFT|RIGHT|INNER|FULL|CROSS|SET)\b`)
+	predicateLeft  = regexp.MustCompile(`(?i)(?:(` + sqlIdent + `)\.)?(` + sqlIdent + `)\s*(=|<>|!=|<=|>=|<|>|\bIN\b|\bLIKE\b|\bBETWEEN\b|\bIS\b)`)
+	predicateRight = regexp.MustCompile(`(?i)=\s*(` + sqlIdent + `)\.(` + sqlIdent + `)`)
+	notAlias       = map[string]bool{
+		"WHERE": true, "JOIN": true, "ON": true, "LEFT": true, "RIGHT": true, "INNER": true, "FULL": true,
+		"CROSS": true, "NATURAL": true, "GROUP": true, "ORDER": true, "LIMIT": true, "OFFSET": true,
+		"USING": true, "SET": true, "VALUES": true, "RETURNING": true, "UNION": true, "FOR": true,
+		"HAVING": true, "WINDOW": true, "SELECT": true, "LATERAL": true,
+	}
+	notColumn = map[string]bool{"AND": true, "OR": true, "NOT": true, "NULL": true, "TRUE": true, "FALSE": true}
+)
+
+// queryTables maps each alias, and each table name, used in query to the
+// table it refers to.
+func queryTables(query string) map[string]string {
+	tables := make(map[string]string)
+	for _, m := range fromPattern.FindAllStringSubmatch(query, -1) {
+		if notAlias[strings.ToUpper(m[1])] {
+			continue
+		}
+		tables[m[1]] = m[1]
+		if i := strings.LastIndex(m[1], "."); i >= 0 {
+			tables[m[1][i+1:]] = m[1]
+		}
+		if m[2] != "" && !notAlias[strings.ToUpper(m[2])] {
+			tables[m[2]] = m[1]
+		}
+	}
+	return tables
+}
+
+// queryPredicates finds the columns a normalized query filters or joins
+// on. It is a heuristic and not a SQL parser: it looks at the text after
+// WHERE and ON, and skips columns it cannot attribute to a table.
+func queryPredicates(query string) []columnPredicate {
+	query = strings.Join(strings.Fields(query), " ")
+	tables := queryTables(query)
+	distinct := make(map[string]bool)
+	for _, t := range tables {
+		distinct[t] = true
+	}
+	resolve := func(qualifier string) string {
+		if qualifier != "" {
+			return tables[qualifier]
+		}
+		if len(distinct) == 1 {
+			for t := range distinct {
+				return t
+			}
+		}
+		return ""
+	}
+	var predicates []columnPredicate
+	seen := make(map[string]bool)
+	add := func(qualifier, column string, equality bool) {
+		table := resolve(qualifier)
+		if table == "" || notColumn[strings.ToUpper(column)] {
+			return
+		}
+		key := table + "." + column
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		predicates = append(predicates, columnPredicate{table, column, equality})
+	}
+	for _, start := range regionStart.FindAllStringIndex(query, -1) {
+		region := query[start[1]:]
+		if end := regionEnd.FindStringIndex(region); end != nil {
+			region = region[:end[0]]
+		}
+		for _, m := range predicateLeft.FindAllStringSubmatch(region, -1) {
+			switch strings.ToUpper(m[3]) {
+			case "<>", "!=":
+			case "=", "IN", "IS":
+				add(m[1], m[2], true)
+			default:
+				add(m[1], m[2], false)
+			}
+		}
+		for _, m := range predicateRight.FindAllStringSubmatch(region, -1) {
+			add(m[1], m[2], true)
+		}
+	}
+	return predicates
+}
+
+// indexCandidate is an index that would serve the predicates of one or
+// more queries
+type indexCandidate struct {
+	Table   string
+	Columns []string
+	Queries []string
+	Calls   int64
+}
+
+// candidateIndexes proposes one index per table a query filters on:
+// equality columns first, then a single range column.
+func candidateIndexes(predicates []columnPredicate) []indexCandidate {
+	var candidates []indexCandidate
+	byTable := make(map[string]int)
+	ranges := make(map[string]string)
+	for _, p := range predicates {
+		i, ok := byTable[p.Table]
+		if !ok {
+			i = len(candidates)
+			candidates = append(candidates, indexCandidate{Table: p.Table})
+			byTable[p.Table] = i
+		}
+		c := &candidates[i]
+		if p.Equality {
+			c.Columns = append(c.Columns, p.Column)
+		} else if ranges[p.Table] == "" {
+			ranges[p.Table] = p.Column
+		}
+	}
+	for i := range candidates {
+		c := &candidates[i]
+		if r := ranges[c.Table]; r != "" {
+			c.Columns = append(c.Columns, r)
+		}
+		if len(c.Columns) > maxIndexColumns {
+			c.Columns = c.Columns[:maxIndexColumns]
+		}
+	}
+	return candidates
+}
+
+func (c indexCandidate) key() string {
+	return c.Table + " (" + strings.Join(c.Columns, ", ") + ")"
+}
+
+func (c indexCandidate) statement() string {
+	return fmt.Sprintf("CREATE INDEX CONCURRENTLY ON %s (%s)", c.Table, strings.Join(c.Columns, ", "))
+}
+
+// planCost returns the total cost of the top node of an EXPLAIN (FORMAT
+// JSON) plan
+func planCost(plan []byte) (float64, error) {
+	var explained []struct {
+		Plan struct {
+			TotalCost float64 `json:"Total Cost"`
+		}
+	}
+	if err := json.Unmarshal(plan, &explained); err != nil {
+		return 0, err
+	}
+	if len(explained) == 0 {
+		return 0, fmt.Errorf("empty plan")
+	}
+	return explained[0].Plan.TotalCost, nil
+}
+
+type indexAdvisorOptions struct {
+	Limit   int
+	MinRows int64
+}
+
+// workloadQuery is a statement from pg_stat_statements
+type workloadQuery struct {
+	Query string
+	Calls int64
+}
+
+func readWorkload(db *sql.DB, version, limit int) ([]workloadQuery, error) {
+	totalTime := "total_exec_time"
+	if version < 130000 {
+		totalTime = "total_time"
+	}
+	rows, err := db.Query(fmt.Sprintf(`SELECT query, calls FROM pg_stat_statements
+  WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+    AND query ~* '^\s*(SELECT|UPDATE|DELETE|WITH)\M'
+  ORDER BY %s DESC
+  LIMIT $1`, totalTime), limit)
+	if err != nil {
+		return nil, fmt.Errorf("reading pg_stat_statements: %s", err)
+	}
+	defer rows.Close()
+	var queries []workloadQuery
+	for rows.Next() {
+		var q workloadQuery
+		if err := rows.Scan(&q.Query, &q.Calls); err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+// seqScanTables returns tables with at least minRows rows that are read
+// by sequential scans more often than through an index, by qualified name.
+func seqScanTables(db *sql.DB, minRows int64) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT relid::regclass::text
+  FROM pg_stat_user_tables
+  WHERE n_live_tup >= $1 AND seq_scan > coalesce(idx_scan, 0)`, minRows)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables[name] = true
+	}
+	return tables, rows.Err()
+}
+
+// indexCovered is true when an existing index starts with columns
+func indexCovered(db *sql.DB, table string, columns []string) (bool, error) {
+	var covered bool
+	err := db.QueryRow(`SELECT EXISTS (
+    SELECT 1 FROM pg_index i
+    WHERE i.indrelid = $1::regclass
+      AND (SELECT array_agg(a.attname::text ORDER BY k.n)
+             FROM unnest(i.indkey::int2[]) WITH ORDINALITY k (attnum, n)
+             JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+            WHERE k.n <= $3) = string_to_array($2, ','))`,
+		table, strings.Join(columns, ","), len(columns)).Scan(&covered)
+	return covered, err
+}
+
+// tableColumns returns the names of the live columns of table
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT attname FROM pg_attribute
+  WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// existingColumns keeps the columns, as written in a query, that name a
+// column of the table. Predicates are attributed to tables heuristically,
+// so a column may belong to another table or be an output alias.
+func existingColumns(columns []string, known map[string]bool) []string {
+	var kept []string
+	for _, c := range columns {
+		name := strings.ToLower(c)
+		if strings.HasPrefix(c, `"`) {
+			name = strings.Replace(strings.Trim(c, `"`), `""`, `"`, -1)
+		}
+		if known[name] {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// estimatedIndexSize guesses the size of a btree from column widths in
+// pg_stats, with per-tuple overhead and the default 90% fill factor.
+func estimatedIndexSize(db *sql.DB, table string, columns []string) (float64, error) {
+	var size sql.NullFloat64
+	err := db.QueryRow(`SELECT c.reltuples * (sum(s.avg_width) + 16) / 0.9
+  FROM pg_class c
+    JOIN pg_namespace n ON n.oid = c.relnamespace
+    JOIN pg_stats s ON s.schemaname = n.nspname AND s.tablename = c.relname
+  WHERE c.oid = $1::regclass AND s.attname = ANY (string_to_array($2, ','))
+  GROUP BY c.reltuples`, table, strings.Join(columns, ",")).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return size.Float64, err
+}
+
+// hypotheticalBenefit compares the cost of each query with and without a
+// hypothetical index created through hypopg, returning the summed costs.
+// Queries with parameters can only be planned generically on PostgreSQL 16,
+// and are left out before that. Hypothetical indexes belong to the backend
+// that made them, so everything runs on one connection, which is reset
+// whatever happens.
+func hypotheticalBenefit(db *sql.DB, version int, c indexCandidate) (before, after, size float64, err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer conn.Close()
+	defer conn.ExecContext(ctx, `SELECT hypopg_reset()`)
+	explain := "EXPLAIN (FORMAT JSON) "
+	if version >= 160000 {
+		explain = "EXPLAIN (GENERIC_PLAN, FORMAT JSON) "
+	}
+	// a failed EXPLAIN aborts the transaction, so each gets its own
+	cost := func(query string) (float64, error) {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		var plan []byte
+		if err := tx.QueryRowContext(ctx, explain+query).Scan(&plan); err != nil {
+			return 0, err
+		}
+		return planCost(plan)
+	}
+	planned, parameterized := 0, 0
+	costs := make([]float64, len(c.Queries))
+	for i, q := range c.Queries {
+		if version < 160000 && placeholder.MatchString(q) {
+			costs[i] = -1
+			parameterized++
+			continue
+		}
+		if costs[i], err = cost(q); err != nil {
+			costs[i] = -1
+			continue
+		}
+		planned++
+	}
+	if planned == 0 && parameterized > 0 {
+		return 0, 0, 0, fmt.Errorf("its queries have parameters, which can only be planned on PostgreSQL 16 or later")
+	}
+	if planned == 0 {
+		return 0, 0, 0, fmt.Errorf("none of the queries could be planned")
+	}
+	var indexrelid int64
+	err = conn.QueryRowContext(ctx, `SELECT indexrelid FROM hypopg_create_index($1)`,
+		fmt.Sprintf("CREATE INDEX ON %s (%s)", c.Table, strings.Join(c.Columns, ", "))).Scan(&indexrelid)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if err := conn.QueryRowContext(ctx, `SELECT hypopg_relation_size($1)`, indexrelid).Scan(&size); err != nil {
+		return 0, 0, 0, err
+	}
+	for i, q := range c.Queries {
+		if costs[i] < 0 {
+			continue
+		}
+		hypothetical, err := cost(q)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		before += costs[i]
+		after += hypothetical
+	}
+	return before, after, size, nil
+}
+
+func indexAdvisor(output io.Writer, opts indexAdvisorOptions) error {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	version, err := serverVersion(db)
+	if err != nil {
+		return err
+	}
+	workload, err := readWorkload(db, version, opts.Limit)
+	if err != nil {
+		return err
+	}
+	heavy, err := seqScanTables(db, opts.MinRows)
+	if err != nil {
+		return err
+	}
+	var hypopg bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'hypopg')`).Scan(&hypopg); err != nil {
+		return err
+	}
+
+	var candidates []*indexCandidate
+	byKey := make(map[string]*indexCandidate)
+	columns := make(map[string]map[string]bool)
+	for _, q := range workload {
+		for _, c := range candidateIndexes(queryPredicates(q.Query)) {
+			var table sql.NullString
+			if err := db.QueryRow(`SELECT to_regclass($1)::text`, c.Table).Scan(&table); err != nil || !table.Valid {
+				continue
+			}
+			if !heavy[table.String] {
+				continue
+			}
+			c.Table = table.String
+			known, ok := columns[c.Table]
+			if !ok {
+				if known, err = tableColumns(db, c.Table); err != nil {
+					return err
+				}
+				columns[c.Table] = known
+			}
+			if c.Columns = existingColumns(c.Columns, known); len(c.Columns) == 0 {
+				continue
+			}
+			existing, ok := byKey[c.key()]
+			if !ok {
+				covered, err := indexCovered(db, c.Table, c.Columns)
+				if err != nil {
+					return err
+				}
+				if covered {
+					continue
+				}
+				existing = &indexCandidate{Table: c.Table, Columns: c.Columns}
+				byKey[c.key()] = existing
+				candidates = append(candidates, existing)
+			}
+			existing.Queries = append(existing.Queries, q.Query)
+			existing.Calls += q.Calls
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Calls > candidates[j].Calls })
+
+	r := &report{Header: []string{"Statement", "Queries", "Calls", "Benefit", "Size"}}
+	for _, c := range candidates {
+		benefit, size := "not validated", ""
+		if hypopg {
+			before, after, hypoSize, err := hypotheticalBenefit(db, version, *c)
+			switch {
+			case err != nil:
+				benefit = "not validated, " + err.Error()
+			case after >= before:
+				// the planner would not use it
+				continue
+			default:
+				benefit = fmt.Sprintf("cost %.0f to %.0f (-%.0f%%)", before, after, 100*(before-after)/before)
+				size = prettyBytes(hypoSize)
+			}
+		}
+		if size == "" {
+			estimate, err := estimatedIndexSize(db, c.Table, c.Columns)
+			if err != nil {
+				return err
+			}
+			size = "~" + prettyBytes(estimate)
+		}
+		r.Append([]string{c.statement(), fmt.Sprint(len(c.Queries)), fmt.Sprint(c.Calls), benefit, size})
+	}
+	if len(r.Rows) == 0 {
+		fmt.Fprintf(output, "no index suggestions from the top %d queries\n", len(workload))
+		return nil
+	}
+	if !hypopg {
+		r.Notes = append(r.Notes, "install the hypopg extension to check that the planner would use each index")
+	} else if version < 160000 {
+		r.Notes = append(r.Notes, "only queries without parameters were validated, "+
+			"PostgreSQL 16 or later can also plan the normalized queries from pg_stat_statements")
+	}
+	r.Notes = append(r.Notes, fmt.Sprintf("based on the top %d statements in pg_stat_statements by total time, "+
+		"on tables with at least %d rows read mostly by sequential scans", len(workload), opts.MinRows))
+	renderReport(output, r)
+	return nil
+}
+
+func indexAdvisorCmd(ctx *cli.Context) error {
+	opts := indexAdvisorOptions{
+		Limit:   ctx.Int("limit"),
+		MinRows: ctx.Int64("min-rows"),
+	}
+	if err := indexAdvisor(os.Stdout, opts); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryPredicates(t *testing.T) {
+	query := `SELECT o.id, c.name
+  FROM orders o
+  JOIN public.customers AS c ON c.id = o.customer_id
+  WHERE o.status = $1 AND o.created_at > $2 AND c.region <> $3
+  ORDER BY o.created_at LIMIT $4`
+	expected := []columnPredicate{
+		{"public.customers", "id", true},
+		{"orders", "customer_id", true},
+		{"orders", "status", true},
+		{"orders", "created_at", false},
+	}
+	if predicates := queryPredicates(query); !reflect.DeepEqual(predicates, expected) {
+		t.Errorf("predicates are %v, expected %v", predicates, expected)
+	}
+
+	expected = []columnPredicate{{"events", "account_id", true}, {"events", "at", false}}
+	predicates := queryPredicates(`SELECT count(*) FROM events WHERE account_id IN ($1, $2) AND at BETWEEN $3 AND $4`)
+	if !reflect.DeepEqual(predicates, expected) {
+		t.Errorf("predicates are %v, expected %v", predicates, expected)
+	}
+}
+
+func TestCandidateIndexes(t *testing.T) {
+	predicates := []columnPredicate{
+		{"orders", "created_at", false},
+		{"orders", "status", true},
+		{"orders", "shipped_at", false},
+		{"customers", "id", true},
+	}
+	expected := []indexCandidate{
+		{Table: "orders", Columns: []string{"status", "created_at"}},
+		{Table: "customers", Columns: []string{"id"}},
+	}
+	if candidates := candidateIndexes(predicates); !reflect.DeepEqual(candidates, expected) {
+		t.Errorf("candidates are %v, expected %v", candidates, expected)
+	}
+	if s := expected[0].statement(); s != "CREATE INDEX CONCURRENTLY ON orders (status, created_at)" {
+		t.Errorf("unexpected statement %q", s)
+	}
+}
+
+func TestPlanCost(t *testing.T) {
+	cost, err := planCost([]byte(`[{"Plan": {"Node Type": "Seq Scan", "Startup Cost": 0.00, "Total Cost": 1693.00}}]`))
+	if err != nil || cost != 1693 {
+		t.Errorf("cost is %v (%v), expected 1693", cost, err)
+	}
+}
+
+func TestExistingColumns(t *testing.T) {
+	known := map[string]bool{"status": true, "createdAt": true}
+	columns := existingColumns([]string{"Status", `"createdAt"`, "created_at", "total"}, known)
+	expected := []string{"Status", `"createdAt"`}
+	if !reflect.DeepEqual(columns, expected) {
+		t.Errorf("columns are %v, expected %v", columns, expected)
+	}
+}
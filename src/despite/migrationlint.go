@@ -0,0 +1,284 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// sqlStatement is one statement of a migration file with comments removed
+// and whitespace collapsed, and the line it starts on.
+type sqlStatement struct {
+	Line int
+	Text string
+}
+
+// splitStatements splits a SQL script on semicolons that are not inside
+// quotes, dollar quotes or comments.
+func splitStatements(script string) []sqlStatement {
+	var statements []sqlStatement
+	var current bytes.Buffer
+	line, start := 1, 0
+	flush := func() {
+		text := strings.Join(strings.Fields(current.String()), " ")
+		if text != "" {
+			statements = append(statements, sqlStatement{start, text})
+		}
+		current.Reset()
+		start = 0
+	}
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		if start == 0 && !isSpace(c) && !strings.HasPrefix(script[i:], "--") && !strings.HasPrefix(script[i:], "/*") {
+			start = line
+		}
+		switch {
+		case c == '\n':
+			line++
+			current.WriteByte(c)
+		case strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			i += end - 1
+			current.WriteByte(' ')
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				end = len(script) - i - 4
+			}
+			comment := script[i : i+end+4]
+			line += strings.Count(comment, "\n")
+			i += len(comment) - 1
+			current.WriteByte(' ')
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(script[i+1:], c)
+			if end < 0 {
+				end = len(script) - i - 2
+			}
+			quoted := script[i : i+end+2]
+			line += strings.Count(quoted, "\n")
+			current.WriteString(quoted)
+			i += len(quoted) - 1
+		case c == '$' && dollarQuote.MatchString(script[i:]):
+			tag := dollarQuote.FindString(script[i:])
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				end = len(script) - i - 2*len(tag)
+			}
+			quoted := script[i : i+end+2*len(tag)]
+			line += strings.Count(quoted, "\n")
+			current.WriteString(quoted)
+			i += len(quoted) - 1
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+var dollarQuote = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+const sqlName = `((?:"[^"]+"|[\w$]+)(?:\.(?:"[^"]+"|[\w$]+))?)`
+
+var (
+	createIndexPattern = regexp.MustCompile(`(?i)^CREATE (UNIQUE )?INDEX (CONCURRENTLY )?(?:.*? )?ON (?:ONLY )?` + sqlName)
+	alterTablePattern  = regexp.MustCompile(`(?i)^ALTER TABLE (?:IF EXISTS )?(?:ONLY )?` + sqlName)
+	addColumnDefault   = regexp.MustCompile(`(?i)\bADD (?:COLUMN )?.*?\bDEFAULT\b(.*)`)
+	volatileDefault    = regexp.MustCompile(`(?i)\b(now|clock_timestamp|statement_timestamp|timeofday|random|nextval|gen_random_uuid|uuid_generate_v[14])\s*\(`)
+	alterColumnType    = regexp.MustCompile(`(?i)\bALTER (?:COLUMN )?\S+ (?:SET DATA )?TYPE\b`)
+	setNotNull         = regexp.MustCompile(`(?i)\bALTER (?:COLUMN )?\S+ SET NOT NULL\b`)
+	addConstraint      = regexp.MustCompile(`(?i)\bADD (?:CONSTRAINT \S+ )?(FOREIGN KEY|CHECK)\b`)
+	notValid           = regexp.MustCompile(`(?i)\bNOT VALID\b`)
+	vacuumFull         = regexp.MustCompile(`(?i)^VACUUM ?(?:\([^)]*\bFULL\b[^)]*\)|FULL(?: FREEZE)?(?: VERBOSE)?(?: ANALYZE)?)(?: ` + sqlName + `)?`)
+	setLockTimeout     = regexp.MustCompile(`(?i)^SET (?:LOCAL |SESSION )?lock_timeout\b`)
+	concurrently       = regexp.MustCompile(`(?i)\bCONCURRENTLY\b`)
+
+	// lockingStatement matches statements that queue for a lock that
+	// conflicts with ordinary reads or writes of a table.
+	lockingStatement = regexp.MustCompile(`(?i)^(ALTER TABLE|DROP TABLE|DROP INDEX|TRUNCATE|CLUSTER|REINDEX|LOCK|CREATE (UNIQUE )?INDEX|CREATE TRIGGER)\b`)
+)
+
+// migrationIssue is a locking hazard in one statement. Table is the
+// table it locks, when it can be told from the statement.
+type migrationIssue struct {
+	Line     int
+	Table    string
+	Severity severity
+	Message  string
+}
+
+// lintMigration flags statements that block reads or writes for longer
+// than an instant. version is the target server version, or 0 if unknown.
+func lintMigration(statements []sqlStatement, version int) []migrationIssue {
+	var issues []migrationIssue
+	lockTimeout := false
+	for _, s := range statements {
+		add := func(table string, sev severity, format string, args ...interface{}) {
+			issues = append(issues, migrationIssue{s.Line, table, sev, fmt.Sprintf(format, args...)})
+		}
+		if setLockTimeout.MatchString(s.Text) {
+			lockTimeout = true
+			continue
+		}
+		var table string
+		if m := createIndexPattern.FindStringSubmatch(s.Text); m != nil {
+			table = m[3]
+			if m[2] == "" {
+				add(table, severityHigh, "CREATE INDEX blocks writes to %s until it finishes, use CREATE INDEX CONCURRENTLY", table)
+			}
+		}
+		if m := alterTablePattern.FindStringSubmatch(s.Text); m != nil {
+			table = m[1]
+			if d := addColumnDefault.FindStringSubmatch(s.Text); d != nil {
+				switch {
+				case volatileDefault.MatchString(d[1]):
+					add(table, severityHigh, "ADD COLUMN with a volatile DEFAULT rewrites %s under an ACCESS EXCLUSIVE lock, "+
+						"add the column without a default and backfill in batches", table)
+				case version == 0:
+					add(table, severityMedium, "ADD COLUMN with a DEFAULT rewrites %s before PostgreSQL 11", table)
+				case version < 110000:
+					add(table, severityHigh, "ADD COLUMN with a DEFAULT rewrites %s on this server version", table)
+				}
+			}
+			if alterColumnType.MatchString(s.Text) {
+				add(table, severityHigh, "ALTER COLUMN TYPE usually rewrites %s and its indexes under an ACCESS EXCLUSIVE lock, "+
+					"add a new column and backfill it instead", table)
+			}
+			if setNotNull.MatchString(s.Text) {
+				add(table, severityMedium, "SET NOT NULL scans %s under an ACCESS EXCLUSIVE lock, add a CHECK (col IS NOT NULL) "+
+					"NOT VALID constraint and VALIDATE it first", table)
+			}
+			if m := addConstraint.FindStringSubmatch(s.Text); m != nil && !notValid.MatchString(s.Text) {
+				add(table, severityMedium, "adding a %s constraint scans %s while holding its lock, add it NOT VALID "+
+					"and VALIDATE CONSTRAINT in a separate statement", strings.ToUpper(m[1]), table)
+			}
+		}
+		full := vacuumFull.FindStringSubmatch(s.Text)
+		if full != nil {
+			table = full[1]
+			add(table, severityHigh, "VACUUM FULL rewrites the table under an ACCESS EXCLUSIVE lock, consider pg_repack")
+		}
+		locking := full != nil || lockingStatement.MatchString(s.Text) && !concurrently.MatchString(s.Text)
+		if !lockTimeout && locking {
+			add(table, severityMedium, "no lock_timeout is set before this statement, so while it waits for its lock "+
+				"every query on the table queues behind it")
+			lockTimeout = true // once per file is enough
+		}
+	}
+	return issues
+}
+
+// tableSizes looks up the total size of each table, leaving out tables
+// that do not exist yet on the target database.
+func tableSizes(db *sql.DB, issues []migrationIssue) (map[string]string, error) {
+	sizes := make(map[string]string)
+	for _, issue := range issues {
+		if issue.Table == "" {
+			continue
+		}
+		if _, ok := sizes[issue.Table]; ok {
+			continue
+		}
+		var size sql.NullString
+		err := db.QueryRow(`SELECT pg_size_pretty(pg_total_relation_size(to_regclass($1)))`, issue.Table).Scan(&size)
+		if err != nil {
+			return nil, err
+		}
+		sizes[issue.Table] = size.String
+	}
+	return sizes, nil
+}
+
+// migrationLint checks each file and returns the number of issues found
+func migrationLint(output io.Writer, files []string, uri string) (int, error) {
+	var db *sql.DB
+	version := 0
+	if uri != "" {
+		var err error
+		db, err = sql.Open("postgres", uri)
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		version, err = serverVersion(db)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var findings []finding
+	for _, file := range files {
+		script, err := ioutil.ReadFile(file)
+		if err != nil {
+			return 0, err
+		}
+		issues := lintMigration(splitStatements(string(script)), version)
+		sizes := map[string]string{}
+		if db != nil {
+			sizes, err = tableSizes(db, issues)
+			if err != nil {
+				return 0, err
+			}
+		}
+		for _, issue := range issues {
+			message := issue.Message
+			if size := sizes[issue.Table]; size != "" {
+				message += fmt.Sprintf(" (%s is %s)", issue.Table, size)
+			}
+			findings = append(findings, finding{issue.Severity, fmt.Sprintf("%s:%d", file, issue.Line), message})
+		}
+	}
+	if len(findings) == 0 {
+		fmt.Fprintf(output, "%d files checked, no locking hazards found\n", len(files))
+		return 0, nil
+	}
+	renderReport(output, findingsReport("Statement", findings))
+	return len(findings), nil
+}
+
+func migrationLintCmd(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return cli.NewExitError("usage: despite pg:migration-lint FILE...", 1)
+	}
+	uri := ""
+	if ctx.Bool("sizes") {
+		uri = dburi
+	}
+	count, err := migrationLint(os.Stdout, ctx.Args(), uri)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	if count > 0 {
+		return cli.NewExitError(fmt.Sprintf("\n%d locking hazards found", count), 1)
+	}
+	return nil
+}
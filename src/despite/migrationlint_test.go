@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- add a column
+SET lock_timeout = '2s';
+ALTER TABLE orders ADD COLUMN note text DEFAULT 'a;b'; /* trailing; comment */
+
+CREATE FUNCTION f() RETURNS int AS $body$
+  SELECT 1;
+$body$ LANGUAGE sql;
+`
+	expected := []sqlStatement{
+		{2, "SET lock_timeout = '2s'"},
+		{3, "ALTER TABLE orders ADD COLUMN note text DEFAULT 'a;b'"},
+		{5, "CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql"},
+	}
+	if statements := splitStatements(script); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("statements are %v, expected %v", statements, expected)
+	}
+}
+
+func TestLintMigration(t *testing.T) {
+	statements := splitStatements(`CREATE INDEX ON public.orders (created_at);
+CREATE INDEX CONCURRENTLY orders_customer ON orders (customer_id);
+ALTER TABLE orders ADD COLUMN id2 uuid DEFAULT gen_random_uuid();
+ALTER TABLE orders ADD COLUMN flag boolean DEFAULT false;
+ALTER TABLE orders ALTER COLUMN total TYPE numeric;
+ALTER TABLE orders ADD CONSTRAINT orders_customer_fk FOREIGN KEY (customer_id) REFERENCES customers NOT VALID;
+ALTER TABLE orders ADD CONSTRAINT total_positive CHECK (total > 0);
+VACUUM (FULL, VERBOSE) orders;
+`)
+	var lines []int
+	var tables []string
+	for _, issue := range lintMigration(statements, 100000) {
+		lines = append(lines, issue.Line)
+		tables = append(tables, issue.Table)
+	}
+	expectedLines := []int{1, 1, 3, 4, 5, 7, 8}
+	if !reflect.DeepEqual(lines, expectedLines) {
+		t.Errorf("issues on lines %v, expected %v", lines, expectedLines)
+	}
+	expectedTables := []string{"public.orders", "public.orders", "orders", "orders", "orders", "orders", "orders"}
+	if !reflect.DeepEqual(tables, expectedTables) {
+		t.Errorf("issues on tables %v, expected %v", tables, expectedTables)
+	}
+	if issues := lintMigration(statements[3:4], 110000); len(issues) != 1 {
+		t.Errorf("a constant default only needs a lock_timeout on PostgreSQL 11, got %v", issues)
+	}
+}
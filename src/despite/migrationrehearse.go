@@ -0,0 +1,276 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// lockModes orders table lock modes from weakest to strongest
+var lockModes = []string{
+	"AccessShareLock", "RowShareLock", "RowExclusiveLock", "ShareUpdateExclusiveLock",
+	"ShareLock", "ShareRowExclusiveLock", "ExclusiveLock", "AccessExclusiveLock",
+}
+
+func lockStrength(mode string) int {
+	for i, m := range lockModes {
+		if m == mode {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	// transactionControl statements are skipped, the rehearsal runs the
+	// whole file in one transaction and must be the one to end it.
+	transactionControl = regexp.MustCompile(`(?i)^(BEGIN|START TRANSACTION|COMMIT|END|ROLLBACK|ABORT|SAVEPOINT|RELEASE|PREPARE TRANSACTION)\b`)
+	// outsideTransaction statements cannot run inside a transaction block
+	outsideTransaction = regexp.MustCompile(`(?i)\bCONCURRENTLY\b|^(VACUUM|CREATE DATABASE|DROP DATABASE|ALTER SYSTEM|CREATE TABLESPACE)\b`)
+)
+
+// rehearsedStatement is what one statement of the migration did
+type rehearsedStatement struct {
+	sqlStatement
+	Elapsed   time.Duration
+	Locks     []string
+	Rewritten []string
+	Skipped   string
+}
+
+// tableLock is the strongest lock the migration took on a relation, from
+// the statement that first acquired it until the transaction ended.
+type tableLock struct {
+	Relation  string
+	Mode      string
+	Line      int
+	Held      time.Duration
+	Rewritten bool
+}
+
+// relationLocks returns the relation locks the current transaction holds,
+// as "relation mode", leaving out locks on system catalogs.
+func relationLocks(tx *sql.Tx) (map[string]string, error) {
+	rows, err := tx.Query(`SELECT l.relation::regclass::text, l.mode
+  FROM pg_locks l
+    JOIN pg_class c ON c.oid = l.relation
+    JOIN pg_namespace n ON n.oid = c.relnamespace
+  WHERE l.pid = pg_backend_pid() AND l.locktype = 'relation' AND l.granted
+    AND ` + userSchemas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	locks := make(map[string]string)
+	for rows.Next() {
+		var relation, mode string
+		if err := rows.Scan(&relation, &mode); err != nil {
+			return nil, err
+		}
+		if lockStrength(mode) > lockStrength(locks[relation]) {
+			locks[relation] = mode
+		}
+	}
+	return locks, rows.Err()
+}
+
+// relationFiles maps each user table, index and materialized view to its
+// relfilenode, which changes when the relation is rewritten.
+func relationFiles(tx *sql.Tx) (map[string]int64, error) {
+	rows, err := tx.Query(`SELECT c.oid::regclass::text, c.relfilenode
+  FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+  WHERE c.relkind IN ('r', 'i', 'm', 't') AND c.relfilenode <> 0 AND ` + userSchemas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make(map[string]int64)
+	for rows.Next() {
+		var relation string
+		var node int64
+		if err := rows.Scan(&relation, &node); err != nil {
+			return nil, err
+		}
+		files[relation] = node
+	}
+	return files, rows.Err()
+}
+
+// rehearse runs statements in a transaction that is always rolled back.
+// It stops at the first statement that fails and returns what ran so far.
+func rehearse(db *sql.DB, statements []sqlStatement, lockTimeout time.Duration) ([]rehearsedStatement, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", lockTimeout/time.Millisecond)); err != nil {
+		return nil, err
+	}
+	files, err := relationFiles(tx)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string]string)
+	var results []rehearsedStatement
+	for _, s := range statements {
+		result := rehearsedStatement{sqlStatement: s}
+		switch {
+		case transactionControl.MatchString(s.Text):
+			result.Skipped = "transaction control"
+		case outsideTransaction.MatchString(s.Text):
+			result.Skipped = "cannot run inside a transaction"
+		}
+		if result.Skipped != "" {
+			results = append(results, result)
+			continue
+		}
+		start := time.Now()
+		_, err := tx.Exec(s.Text)
+		result.Elapsed = time.Since(start)
+		results = append(results, result)
+		if err != nil {
+			return results, fmt.Errorf("line %d: %s", s.Line, err)
+		}
+		r := &results[len(results)-1]
+		locks, err := relationLocks(tx)
+		if err != nil {
+			return results, err
+		}
+		for relation, mode := range locks {
+			if lockStrength(mode) > lockStrength(held[relation]) {
+				held[relation] = mode
+				r.Locks = append(r.Locks, relation+" "+mode)
+			}
+		}
+		sort.Strings(r.Locks)
+		after, err := relationFiles(tx)
+		if err != nil {
+			return results, err
+		}
+		for relation, node := range after {
+			if before, ok := files[relation]; ok && before != node {
+				r.Rewritten = append(r.Rewritten, relation)
+			}
+		}
+		sort.Strings(r.Rewritten)
+		files = after
+	}
+	return results, nil
+}
+
+// tableLocks works out how long the strongest lock on each relation would
+// be held if the migration committed: from the statement that took that
+// mode to the end of the file.
+func tableLocks(results []rehearsedStatement) []tableLock {
+	var total time.Duration
+	for _, r := range results {
+		total += r.Elapsed
+	}
+	byRelation := make(map[string]*tableLock)
+	var order []string
+	var elapsed time.Duration
+	for _, r := range results {
+		for _, lock := range r.Locks {
+			i := strings.LastIndex(lock, " ")
+			relation, mode := lock[:i], lock[i+1:]
+			t, ok := byRelation[relation]
+			if !ok {
+				t = &tableLock{Relation: relation}
+				byRelation[relation] = t
+				order = append(order, relation)
+			}
+			if lockStrength(mode) > lockStrength(t.Mode) {
+				t.Mode, t.Line, t.Held = mode, r.Line, total-elapsed
+			}
+		}
+		for _, relation := range r.Rewritten {
+			if t, ok := byRelation[relation]; ok {
+				t.Rewritten = true
+			}
+		}
+		elapsed += r.Elapsed
+	}
+	locks := make([]tableLock, 0, len(order))
+	for _, relation := range order {
+		locks = append(locks, *byRelation[relation])
+	}
+	return locks
+}
+
+func rehearsalReports(results []rehearsedStatement) (statements *report, locks *report) {
+	statements = &report{Header: []string{"Line", "Statement", "Elapsed", "LocksAcquired", "Rewritten"}}
+	for _, r := range results {
+		elapsed := r.Elapsed.Round(time.Millisecond).String()
+		if r.Skipped != "" {
+			elapsed = "skipped, " + r.Skipped
+		}
+		statements.Append([]string{strconv.Itoa(r.Line), shortQuery(r.Text, 60), elapsed,
+			strings.Join(r.Locks, ", "), strings.Join(r.Rewritten, ", ")})
+	}
+	locks = &report{Header: []string{"Relation", "Mode", "FromLine", "HeldFor", "Rewritten"}}
+	for _, t := range tableLocks(results) {
+		rewritten := ""
+		if t.Rewritten {
+			rewritten = "yes"
+		}
+		locks.Append([]string{t.Relation, t.Mode, strconv.Itoa(t.Line), t.Held.Round(time.Millisecond).String(), rewritten})
+	}
+	locks.Notes = []string{"locks are held until the migration commits, AccessExclusiveLock blocks reads as well as writes",
+		"the rehearsal was rolled back, nothing was committed"}
+	return statements, locks
+}
+
+func migrationRehearse(output io.Writer, file string, lockTimeout time.Duration) error {
+	script, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	results, runErr := rehearse(db, splitStatements(string(script)), lockTimeout)
+	statements, locks := rehearsalReports(results)
+	renderReport(output, statements)
+	if len(locks.Rows) > 0 {
+		fmt.Fprintln(output, "\nlocks taken")
+		renderReport(output, locks)
+	}
+	return runErr
+}
+
+func migrationRehearseCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("usage: despite pg:migration-rehearse FILE", 1)
+	}
+	err := migrationRehearse(os.Stdout, ctx.Args().First(), ctx.Duration("lock-timeout"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s, rolled back", err), 1)
+	}
+	return nil
+}
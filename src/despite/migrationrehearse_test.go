@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTableLocks(t *testing.T) {
+	results := []rehearsedStatement{
+		{sqlStatement: sqlStatement{1, "SET lock_timeout = '2s'"}, Elapsed: time.Millisecond},
+		{sqlStatement: sqlStatement{2, "UPDATE orders SET total = 0"}, Elapsed: 3 * time.Second,
+			Locks: []string{"orders RowExclusiveLock"}},
+		{sqlStatement: sqlStatement{3, "ALTER TABLE orders ALTER total TYPE numeric"}, Elapsed: 2 * time.Second,
+			Locks:     []string{"orders AccessExclusiveLock", "orders_pkey AccessExclusiveLock"},
+			Rewritten: []string{"orders", "orders_pkey"}},
+		{sqlStatement: sqlStatement{4, "CREATE INDEX CONCURRENTLY ON orders (total)"}, Skipped: "cannot run inside a transaction"},
+	}
+	expected := []tableLock{
+		{"orders", "AccessExclusiveLock", 3, 2 * time.Second, true},
+		{"orders_pkey", "AccessExclusiveLock", 3, 2 * time.Second, true},
+	}
+	if locks := tableLocks(results); !reflect.DeepEqual(locks, expected) {
+		t.Errorf("locks are %v, expected %v", locks, expected)
+	}
+}
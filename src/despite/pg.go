@@ -0,0 +1,45 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// serverVersion returns server_version_num, e.g. 90605 or 170002, so that
+// commands can pick catalog queries that exist on the connected server.
+func serverVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&version)
+	return version, err
+}
+
+// quoteIdent quotes an identifier for use in SQL we build ourselves, for
+// statements like VACUUM and REINDEX that cannot take parameters.
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// quoteLiteral quotes a string constant, using an E'...' escape string when it
+// contains backslashes so the result does not depend on
+// standard_conforming_strings.
+func quoteLiteral(s string) string {
+	s = strings.Replace(s, `'`, `''`, -1)
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.Replace(s, `\`, `\\`, -1) + `'`
+	}
+	return `'` + s + `'`
+}
@@ -0,0 +1,434 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/urfave/cli"
+)
+
+// planNode is the part of an EXPLAIN (FORMAT JSON) node that makes up
+// the plan's shape. The cost is only reported, it is left out of the shape
+// because it moves with every analyze without the plan changing.
+type planNode struct {
+	NodeType  string     `json:"Node Type"`
+	Strategy  string     `json:"Strategy"`
+	JoinType  string     `json:"Join Type"`
+	Relation  string     `json:"Relation Name"`
+	Index     string     `json:"Index Name"`
+	Plans     []planNode `json:"Plans"`
+	TotalCost float64    `json:"Total Cost"`
+}
+
+// planShape renders a plan as one indented line per node
+func planShape(node planNode, depth int, lines []string) []string {
+	line := strings.Repeat("  ", depth) + node.NodeType
+	if node.Strategy != "" && node.Strategy != "Plain" {
+		line += " " + node.Strategy
+	}
+	if node.JoinType != "" && node.JoinType != "Inner" {
+		line += " " + node.JoinType
+	}
+	if node.Index != "" {
+		line += " using " + node.Index
+	}
+	if node.Relation != "" {
+		line += " on " + node.Relation
+	}
+	lines = append(lines, line)
+	for _, child := range node.Plans {
+		lines = planShape(child, depth+1, lines)
+	}
+	return lines
+}
+
+func planFingerprint(shape []string) string {
+	sum := sha1.Sum([]byte(strings.Join(shape, "\n")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// trackedPlan is the last plan seen for a query, kept in the state file
+type trackedPlan struct {
+	Query       string    `json:"query"`
+	Fingerprint string    `json:"fingerprint"`
+	Shape       []string  `json:"shape"`
+	Cost        float64   `json:"cost"`
+	CapturedAt  time.Time `json:"captured_at"`
+}
+
+// planChange is a query whose plan shape differs from the stored one
+type planChange struct {
+	QueryID string
+	Before  trackedPlan
+	After   trackedPlan
+}
+
+// planParams reads representative parameters for queries with
+// placeholders from the config file, which looks like:
+//
+//	plan-track:
+//	  queries:
+//	    - queryid: "-6307893459843574412"
+//	      params: ["42", "2016-01-01"]
+func planParams(cfg *config.Config) (map[string][]string, error) {
+	params := make(map[string][]string)
+	if cfg == nil {
+		return params, nil
+	}
+	for i := range cfg.UList("plan-track.queries") {
+		prefix := fmt.Sprintf("plan-track.queries.%d.", i)
+		id, err := cfg.String(prefix + "queryid")
+		if err != nil {
+			return nil, err
+		}
+		var values []string
+		for _, v := range cfg.UList(prefix + "params") {
+			values = append(values, fmt.Sprint(v))
+		}
+		params[id] = values
+	}
+	return params, nil
+}
+
+var placeholder = regexp.MustCompile(`\$[0-9]+`)
+
+// bindParams replaces the $n placeholders of a normalized query with
+// params as literals, or returns false if there are not enough of them.
+func bindParams(query string, params []string) (string, bool) {
+	ok := true
+	bound := placeholder.ReplaceAllStringFunc(query, func(p string) string {
+		n, _ := strconv.Atoi(p[1:])
+		if n < 1 || n > len(params) {
+			ok = false
+			return p
+		}
+		return quoteLiteral(params[n-1])
+	})
+	return bound, ok
+}
+
+// explainQuery returns the plan of query without running it. Queries with
+// placeholders are explained with params bound, or planned generically on
+// PostgreSQL 16 when there are none.
+func explainQuery(tx *sql.Tx, version int, query string, params []string) (planNode, error) {
+	explain := "EXPLAIN (FORMAT JSON) "
+	if placeholder.MatchString(query) {
+		bound, ok := bindParams(query, params)
+		switch {
+		case ok:
+			query = bound
+		case version >= 160000:
+			explain = "EXPLAIN (GENERIC_PLAN, FORMAT JSON) "
+		default:
+			return planNode{}, fmt.Errorf("it has parameters, add them to the config file")
+		}
+	}
+	var plan []byte
+	if err := tx.QueryRow(explain + query).Scan(&plan); err != nil {
+		return planNode{}, err
+	}
+	var explained []struct {
+		Plan planNode `json:"Plan"`
+	}
+	if err := json.Unmarshal(plan, &explained); err != nil {
+		return planNode{}, err
+	}
+	if len(explained) == 0 {
+		return planNode{}, fmt.Errorf("empty plan")
+	}
+	return explained[0].Plan, nil
+}
+
+// trackedQuery is a top statement from pg_stat_statements
+type trackedQuery struct {
+	ID    string
+	Query string
+}
+
+func readTopQueries(db *sql.DB, version, limit int) ([]trackedQuery, error) {
+	totalTime := "total_exec_time"
+	if version < 130000 {
+		totalTime = "total_time"
+	}
+	rows, err := db.Query(fmt.Sprintf(`SELECT queryid::text, query FROM pg_stat_statements
+  WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+    AND query ~* '^\s*(SELECT|INSERT|UPDATE|DELETE|WITH)\M'
+  ORDER BY %s DESC
+  LIMIT $1`, totalTime), limit)
+	if err != nil {
+		return nil, fmt.Errorf("reading pg_stat_statements: %s", err)
+	}
+	defer rows.Close()
+	var queries []trackedQuery
+	for rows.Next() {
+		var q trackedQuery
+		if err := rows.Scan(&q.ID, &q.Query); err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+// capturePlans explains each query in a transaction that is rolled back,
+// returning the plans and why any query could not be explained.
+func capturePlans(db *sql.DB, version int, queries []trackedQuery,
+	params map[string][]string) (map[string]trackedPlan, []string, error) {
+	plans := make(map[string]trackedPlan)
+	var skipped []string
+	for _, q := range queries {
+		// a failed EXPLAIN aborts the transaction, so each gets its own
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, nil, err
+		}
+		node, err := explainQuery(tx, version, q.Query, params[q.ID])
+		tx.Rollback()
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("queryid %s was not explained: %s", q.ID, err))
+			continue
+		}
+		shape := planShape(node, 0, nil)
+		plans[q.ID] = trackedPlan{
+			Query:       q.Query,
+			Fingerprint: planFingerprint(shape),
+			Shape:       shape,
+			Cost:        node.TotalCost,
+			CapturedAt:  time.Now().UTC(),
+		}
+	}
+	return plans, skipped, nil
+}
+
+// comparePlans records current plans in stored and returns the queries
+// whose plan shape changed, ordered by query id.
+func comparePlans(stored, current map[string]trackedPlan) []planChange {
+	var changes []planChange
+	for id, plan := range current {
+		if before, ok := stored[id]; ok && before.Fingerprint != plan.Fingerprint {
+			changes = append(changes, planChange{id, before, plan})
+		}
+		stored[id] = plan
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].QueryID < changes[j].QueryID })
+	return changes
+}
+
+// sideBySide lines up two plans, marking removed lines with <, added
+// lines with > and changed lines with |, like sdiff.
+func sideBySide(before, after []string) *report {
+	// longest common subsequence of lines
+	lcs := make([][]int, len(before)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	r := &report{Header: []string{"Before", "", "After"}}
+	var removed, added []string
+	flush := func() {
+		for len(removed) > 0 || len(added) > 0 {
+			var b, a string
+			marker := "|"
+			switch {
+			case len(removed) == 0:
+				a, added, marker = added[0], added[1:], ">"
+			case len(added) == 0:
+				b, removed, marker = removed[0], removed[1:], "<"
+			default:
+				b, removed = removed[0], removed[1:]
+				a, added = added[0], added[1:]
+			}
+			r.Append([]string{b, marker, a})
+		}
+	}
+	i, j := 0, 0
+	for i < len(before) || j < len(after) {
+		switch {
+		case i < len(before) && j < len(after) && before[i] == after[j]:
+			flush()
+			r.Append([]string{before[i], "", after[j]})
+			i++
+			j++
+		case j < len(after) && (i == len(before) || lcs[i][j+1] >= lcs[i+1][j]):
+			added = append(added, after[j])
+			j++
+		default:
+			removed = append(removed, before[i])
+			i++
+		}
+	}
+	flush()
+	return r
+}
+
+func readPlanState(filename string) (map[string]trackedPlan, error) {
+	stored := make(map[string]trackedPlan)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return stored, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&stored); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return stored, nil
+}
+
+func writePlanState(filename string, stored map[string]trackedPlan) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(stored); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type planTrackOptions struct {
+	Limit    int
+	State    string
+	Params   map[string][]string
+	Interval time.Duration
+}
+
+// trackPlans captures plans once, reports changes against the state file
+// and saves the new plans to it. It returns the number of changed plans.
+func trackPlans(output io.Writer, db *sql.DB, opts planTrackOptions) (int, error) {
+	version, err := serverVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	queries, err := readTopQueries(db, version, opts.Limit)
+	if err != nil {
+		return 0, err
+	}
+	current, skipped, err := capturePlans(db, version, queries, opts.Params)
+	if err != nil {
+		return 0, err
+	}
+	stored, err := readPlanState(opts.State)
+	if err != nil {
+		return 0, err
+	}
+	known := len(stored)
+	changes := comparePlans(stored, current)
+	if err := writePlanState(opts.State, stored); err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(output, "%s: %d plans captured, %d changed", time.Now().Format(time.RFC3339), len(current), len(changes))
+	if known == 0 {
+		fmt.Fprintf(output, ", saved to %s as the baseline", opts.State)
+	}
+	fmt.Fprintln(output)
+	for _, note := range skipped {
+		fmt.Fprintf(output, "* %s\n", note)
+	}
+	for _, c := range changes {
+		fmt.Fprintf(output, "\nqueryid %s: %s\nplan changed, cost %.0f to %.0f, last seen %s\n", c.QueryID,
+			shortQuery(c.After.Query, 80), c.Before.Cost, c.After.Cost, c.Before.CapturedAt.Format(time.RFC3339))
+		renderReport(output, sideBySide(c.Before.Shape, c.After.Shape))
+	}
+	return len(changes), nil
+}
+
+func planTrack(output io.Writer, opts planTrackOptions) (int, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	if opts.Interval <= 0 {
+		return trackPlans(output, db, opts)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	total := 0
+	for {
+		changed, err := trackPlans(output, db, opts)
+		if err != nil {
+			// keep going, like watch, a blip should not end tracking
+			fmt.Fprintf(output, "%s: %s\n", time.Now().Format(time.RFC3339), err)
+		}
+		total += changed
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return total, nil
+		}
+	}
+}
+
+func planTrackCmd(ctx *cli.Context) error {
+	var cfg *config.Config
+	if filename := ctx.String("config"); filename != "" {
+		var err error
+		cfg, err = config.ParseYamlFile(filename)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %s", filename, err), 1)
+		}
+	}
+	params, err := planParams(cfg)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	opts := planTrackOptions{
+		Limit:    ctx.Int("limit"),
+		State:    ctx.String("state"),
+		Params:   params,
+		Interval: ctx.GlobalDuration("watch"),
+	}
+	changed, err := planTrack(os.Stdout, opts)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	if changed > 0 {
+		return cli.NewExitError(fmt.Sprintf("\n%d plans changed", changed), 1)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPlanShape(t *testing.T) {
+	var explained []struct {
+		Plan planNode `json:"Plan"`
+	}
+	plan := `[{"Plan": {"Node Type": "Hash Join", "Join Type": "Inner", "Total Cost": 120.5, "Plans": [
+    {"Node Type": "Seq Scan", "Relation Name": "orders", "Total Cost": 80},
+    {"Node Type": "Hash", "Plans": [
+      {"Node Type": "Index Scan", "Index Name": "customers_pkey", "Relation Name": "customers"}]}]}}]`
+	if err := json.Unmarshal([]byte(plan), &explained); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"Hash Join",
+		"  Seq Scan on orders",
+		"  Hash",
+		"    Index Scan using customers_pkey on customers",
+	}
+	shape := planShape(explained[0].Plan, 0, nil)
+	if !reflect.DeepEqual(shape, expected) {
+		t.Errorf("shape is %q, expected %q", shape, expected)
+	}
+	if planFingerprint(shape) == planFingerprint(shape[1:]) {
+		t.Errorf("different shapes should have different fingerprints")
+	}
+}
+
+func TestBindParams(t *testing.T) {
+	bound, ok := bindParams("SELECT * FROM t WHERE a = $1 AND b = $10 AND c = $2", []string{"1", "it's", "", "", "", "", "", "", "", "x"})
+	if !ok || bound != "SELECT * FROM t WHERE a = '1' AND b = 'x' AND c = 'it''s'" {
+		t.Errorf("bound query is %q (%t)", bound, ok)
+	}
+	if _, ok := bindParams("SELECT $1, $2", []string{"1"}); ok {
+		t.Errorf("expected binding to fail with too few params")
+	}
+}
+
+func TestComparePlans(t *testing.T) {
+	stored := map[string]trackedPlan{"1": {Fingerprint: "a"}, "2": {Fingerprint: "b"}}
+	current := map[string]trackedPlan{"1": {Fingerprint: "a"}, "2": {Fingerprint: "c"}, "3": {Fingerprint: "d"}}
+	changes := comparePlans(stored, current)
+	if len(changes) != 1 || changes[0].QueryID != "2" {
+		t.Errorf("expected only query 2 to change, got %v", changes)
+	}
+	if len(stored) != 3 || stored["2"].Fingerprint != "c" {
+		t.Errorf("stored plans were not updated: %v", stored)
+	}
+}
+
+func TestSideBySide(t *testing.T) {
+	before := []string{"Hash Join", "  Seq Scan on orders", "  Hash", "    Seq Scan on customers"}
+	after := []string{"Nested Loop", "  Seq Scan on orders", "  Index Scan using customers_pkey on customers"}
+	expected := [][]string{
+		{"Hash Join", "|", "Nested Loop"},
+		{"  Seq Scan on orders", "", "  Seq Scan on orders"},
+		{"  Hash", "|", "  Index Scan using customers_pkey on customers"},
+		{"    Seq Scan on customers", "<", ""},
+	}
+	if r := sideBySide(before, after); !reflect.DeepEqual(r.Rows, expected) {
+		t.Errorf("diff is %q, expected %q", r.Rows, expected)
+	}
+}
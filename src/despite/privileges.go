@@ -0,0 +1,290 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// privilegeKind describes how to list one kind of object and check
+// privileges on it. objects must return oid, name, owner and acl.
+type privilegeKind struct {
+	objects    string
+	aclType    string
+	check      string
+	privileges []string
+}
+
+var privilegeKinds = map[string]privilegeKind{
+	"tables": {
+		objects: `SELECT c.oid, format('%I.%I', n.nspname, c.relname), c.relowner, c.relacl
+      FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+      WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f')
+        AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname !~ '^pg_toast'`,
+		aclType:    "r",
+		check:      "has_table_privilege",
+		privileges: []string{"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"},
+	},
+	"sequences": {
+		objects: `SELECT c.oid, format('%I.%I', n.nspname, c.relname), c.relowner, c.relacl
+      FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+      WHERE c.relkind = 'S'`,
+		aclType:    "s",
+		check:      "has_sequence_privilege",
+		privileges: []string{"USAGE", "SELECT", "UPDATE"},
+	},
+	"schemas": {
+		objects: `SELECT oid, quote_ident(nspname), nspowner, nspacl
+      FROM pg_namespace
+      WHERE nspname NOT IN ('pg_catalog', 'information_schema') AND nspname !~ '^pg_'`,
+		aclType:    "n",
+		check:      "has_schema_privilege",
+		privileges: []string{"USAGE", "CREATE"},
+	},
+	"functions": {
+		objects: `SELECT p.oid, p.oid::regprocedure::text, p.proowner, p.proacl
+      FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace
+      WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')`,
+		aclType:    "f",
+		check:      "has_function_privilege",
+		privileges: []string{"EXECUTE"},
+	},
+}
+
+// privilegeLetters are the abbreviations aclitem uses, see \dp in psql
+var privilegeLetters = map[string]string{
+	"SELECT": "r", "INSERT": "a", "UPDATE": "w", "DELETE": "d", "TRUNCATE": "D",
+	"REFERENCES": "x", "TRIGGER": "t", "USAGE": "U", "CREATE": "C", "EXECUTE": "X",
+}
+
+// privilegesQuery finds every privilege each role effectively holds, and
+// where it comes from: owner, superuser, PUBLIC, the roles it inherits it
+// from, or empty for a direct grant.
+const privilegesQuery = `WITH objects (oid, name, owner, acl) AS (%s),
+  grants AS (
+    SELECT o.oid, a.grantee, a.privilege_type
+      FROM objects o, aclexplode(coalesce(o.acl, acldefault('%s', o.owner))) a
+  )
+SELECT r.rolname, o.name, p.privilege,
+    CASE
+      WHEN r.rolsuper THEN 'superuser'
+      WHEN r.oid = o.owner THEN 'owner'
+      WHEN EXISTS (SELECT 1 FROM grants g
+                    WHERE g.oid = o.oid AND g.grantee = r.oid AND g.privilege_type = p.privilege) THEN ''
+      WHEN EXISTS (SELECT 1 FROM grants g
+                    WHERE g.oid = o.oid AND g.grantee = 0 AND g.privilege_type = p.privilege) THEN 'PUBLIC'
+      ELSE coalesce((SELECT string_agg(DISTINCT pg_get_userbyid(g.grantee), ',')
+                       FROM grants g
+                      WHERE g.oid = o.oid AND g.privilege_type = p.privilege
+                        AND g.grantee NOT IN (0, r.oid)
+                        AND pg_has_role(r.oid, g.grantee, 'USAGE')), '')
+    END
+  FROM objects o
+    CROSS JOIN pg_roles r
+    CROSS JOIN unnest($3::text[]) AS p (privilege)
+  WHERE r.rolname !~ '^pg_'
+    AND (NOT r.rolsuper OR $1 <> '')
+    AND ($1 = '' OR r.rolname = $1)
+    AND ($2 = '' OR o.name LIKE $2)
+    AND %s(r.oid, o.oid, p.privilege)
+  ORDER BY o.name, r.rolname`
+
+// privilegeGrant is one privilege a role effectively holds on an object
+type privilegeGrant struct {
+	Role      string `json:"role"`
+	Object    string `json:"object"`
+	Privilege string `json:"privilege"`
+	Via       string `json:"via,omitempty"`
+}
+
+// defaultPrivilege is one entry of ALTER DEFAULT PRIVILEGES
+type defaultPrivilege struct {
+	Owner      string `json:"owner"`
+	Schema     string `json:"schema"`
+	ObjectType string `json:"object_type"`
+	Grantee    string `json:"grantee"`
+	Privileges string `json:"privileges"`
+}
+
+func readPrivileges(db *sql.DB, kind privilegeKind, role, object string) ([]privilegeGrant, error) {
+	query := fmt.Sprintf(privilegesQuery, kind.objects, kind.aclType, kind.check)
+	privileges := "{" + strings.Join(kind.privileges, ",") + "}"
+	rows, err := db.Query(query, role, object, privileges)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var grants []privilegeGrant
+	for rows.Next() {
+		var g privilegeGrant
+		if err := rows.Scan(&g.Role, &g.Object, &g.Privilege, &g.Via); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+func readDefaultPrivileges(db *sql.DB, role string) ([]defaultPrivilege, error) {
+	rows, err := db.Query(`SELECT pg_get_userbyid(d.defaclrole), coalesce(n.nspname, '*'),
+    CASE d.defaclobjtype WHEN 'r' THEN 'tables' WHEN 'S' THEN 'sequences' WHEN 'f' THEN 'functions'
+      WHEN 'T' THEN 'types' WHEN 'n' THEN 'schemas' ELSE d.defaclobjtype::text END,
+    CASE a.grantee WHEN 0 THEN 'PUBLIC' ELSE pg_get_userbyid(a.grantee) END,
+    string_agg(a.privilege_type, ',' ORDER BY a.privilege_type)
+  FROM pg_default_acl d
+    LEFT JOIN pg_namespace n ON n.oid = d.defaclnamespace,
+    aclexplode(d.defaclacl) a
+  WHERE $1 = '' OR pg_get_userbyid(a.grantee) = $1 OR pg_get_userbyid(d.defaclrole) = $1
+  GROUP BY 1, 2, 3, 4
+  ORDER BY 1, 2, 3, 4`, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var defaults []defaultPrivilege
+	for rows.Next() {
+		var d defaultPrivilege
+		if err := rows.Scan(&d.Owner, &d.Schema, &d.ObjectType, &d.Grantee, &d.Privileges); err != nil {
+			return nil, err
+		}
+		defaults = append(defaults, d)
+	}
+	return defaults, rows.Err()
+}
+
+// privilegeMatrix lays grants out with a row per object and a column per
+// role. Each cell lists privilege letters, with those not granted directly
+// grouped under where they come from, e.g. "r PUBLIC:x app_rw:awd".
+func privilegeMatrix(grants []privilegeGrant) *report {
+	var roles, objects []string
+	cells := make(map[string]map[string]map[string]string)
+	for _, g := range grants {
+		if cells[g.Object] == nil {
+			cells[g.Object] = make(map[string]map[string]string)
+			objects = append(objects, g.Object)
+		}
+		if cells[g.Object][g.Role] == nil {
+			cells[g.Object][g.Role] = make(map[string]string)
+		}
+		cells[g.Object][g.Role][g.Via] += privilegeLetters[g.Privilege]
+		roles = appendUnique(roles, g.Role)
+	}
+	sort.Strings(roles)
+	r := &report{Header: append([]string{"Object"}, roles...)}
+	for _, object := range objects {
+		row := []string{object}
+		for _, role := range roles {
+			row = append(row, privilegeCell(cells[object][role]))
+		}
+		r.Append(row)
+	}
+	r.Notes = []string{"r=SELECT a=INSERT w=UPDATE d=DELETE D=TRUNCATE x=REFERENCES t=TRIGGER " +
+		"U=USAGE C=CREATE X=EXECUTE; role:letters are inherited through membership in role"}
+	return r
+}
+
+func privilegeCell(bySource map[string]string) string {
+	if bySource == nil {
+		return ""
+	}
+	if _, ok := bySource["superuser"]; ok {
+		return "superuser"
+	}
+	if _, ok := bySource["owner"]; ok {
+		return "owner"
+	}
+	var sources []string
+	for source := range bySource {
+		if source != "" {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	var parts []string
+	if direct := bySource[""]; direct != "" {
+		parts = append(parts, direct)
+	}
+	for _, source := range sources {
+		parts = append(parts, source+":"+bySource[source])
+	}
+	return strings.Join(parts, " ")
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func privileges(output io.Writer, kindName, role, object string, asJSON bool) error {
+	kind, ok := privilegeKinds[kindName]
+	if !ok {
+		return fmt.Errorf("unknown object type %q, use tables, sequences, schemas or functions", kindName)
+	}
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	grants, err := readPrivileges(db, kind, role, object)
+	if err != nil {
+		return err
+	}
+	defaults, err := readDefaultPrivileges(db, role)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(output)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Privileges        []privilegeGrant   `json:"privileges"`
+			DefaultPrivileges []defaultPrivilege `json:"default_privileges"`
+		}{grants, defaults})
+	}
+	matrix := privilegeMatrix(grants)
+	if role == "" {
+		matrix.Notes = append(matrix.Notes, "superusers hold every privilege and are left out unless named with --role")
+	}
+	renderReport(output, matrix)
+	if len(defaults) > 0 {
+		d := &report{Header: []string{"Owner", "Schema", "ObjectType", "Grantee", "Privileges"}}
+		for _, p := range defaults {
+			d.Append([]string{p.Owner, p.Schema, p.ObjectType, p.Grantee, p.Privileges})
+		}
+		fmt.Fprintln(output, "\ndefault privileges")
+		renderReport(output, d)
+	}
+	return nil
+}
+
+func privilegesCmd(ctx *cli.Context) error {
+	err := privileges(os.Stdout, ctx.String("type"), ctx.String("role"), ctx.String("object"), ctx.Bool("json"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrivilegeMatrix(t *testing.T) {
+	grants := []privilegeGrant{
+		{"app", "public.users", "SELECT", ""},
+		{"app", "public.users", "INSERT", "app_rw"},
+		{"app", "public.users", "UPDATE", "app_rw"},
+		{"app", "public.users", "REFERENCES", "PUBLIC"},
+		{"admin", "public.users", "SELECT", "owner"},
+		{"app", "public.events", "SELECT", ""},
+	}
+	r := privilegeMatrix(grants)
+	expectedHeader := []string{"Object", "admin", "app"}
+	if !reflect.DeepEqual(r.Header, expectedHeader) {
+		t.Errorf("header is %v, expected %v", r.Header, expectedHeader)
+	}
+	expected := [][]string{
+		{"public.users", "owner", "r PUBLIC:x app_rw:aw"},
+		{"public.events", "", "r"},
+	}
+	if !reflect.DeepEqual(r.Rows, expected) {
+		t.Errorf("matrix is %v, expected %v", r.Rows, expected)
+	}
+}
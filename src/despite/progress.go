@@ -0,0 +1,188 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// progressView maps one pg_stat_progress_* view onto common columns:
+// pid, operation, relation, phase, work done and total work.
+type progressView struct {
+	since int
+	query string
+}
+
+var progressViews = []progressView{
+	{90600, `SELECT pid, 'VACUUM', relid::regclass::text, phase,
+      CASE WHEN phase = 'scanning heap' THEN heap_blks_scanned ELSE heap_blks_vacuumed END,
+      heap_blks_total
+    FROM pg_stat_progress_vacuum`},
+	{120000, `SELECT pid, command, coalesce(index_relid::regclass::text, relid::regclass::text), phase,
+      CASE WHEN blocks_total > 0 THEN blocks_done ELSE tuples_done END,
+      CASE WHEN blocks_total > 0 THEN blocks_total ELSE tuples_total END
+    FROM pg_stat_progress_create_index`},
+	{120000, `SELECT pid, command, relid::regclass::text, phase,
+      heap_blks_scanned, heap_blks_total
+    FROM pg_stat_progress_cluster`},
+	{130000, `SELECT pid, 'ANALYZE', relid::regclass::text, phase,
+      sample_blks_scanned, sample_blks_total
+    FROM pg_stat_progress_analyze`},
+	{130000, `SELECT pid, 'BASE BACKUP', '', phase,
+      backup_streamed, coalesce(backup_total, 0)
+    FROM pg_stat_progress_basebackup`},
+	{140000, `SELECT pid, command, coalesce(relid::regclass::text, ''), type,
+      bytes_processed, bytes_total
+    FROM pg_stat_progress_copy`},
+}
+
+// progressQuery unions the progress views that exist on version
+func progressQuery(version int) string {
+	var parts []string
+	for _, v := range progressViews {
+		if version >= v.since {
+			parts = append(parts, v.query)
+		}
+	}
+	return `SELECT p.*, extract(epoch FROM clock_timestamp() - a.query_start),
+    a.query_start::text, extract(epoch FROM clock_timestamp())
+  FROM (` + strings.Join(parts, "\n  UNION ALL\n  ") + `) AS p (pid, operation, relation, phase, done, total)
+    JOIN pg_stat_activity a USING (pid)
+  ORDER BY a.query_start`
+}
+
+// progressEstimate returns the percent complete and a linear estimate of
+// the time remaining. Both are empty when the total work is unknown.
+func progressEstimate(elapsed time.Duration, done, total float64) (percent string, eta string) {
+	if total <= 0 {
+		return "", ""
+	}
+	fraction := done / total
+	percent = fmt.Sprintf("%.1f%%", 100*fraction)
+	if fraction <= 0 {
+		return percent, ""
+	}
+	remaining := time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+	return percent, remaining.Truncate(time.Second).String()
+}
+
+// phaseSighting is when a phase of an operation was first seen, by the
+// server clock in seconds, and how much work was done by then
+type phaseSighting struct {
+	at   float64
+	done float64
+}
+
+// phaseTracker remembers when each running operation was first seen in its
+// current phase. Done and total only count work within a phase, so the
+// time remaining is estimated from the rate seen since then, rather than
+// from the time the whole command has been running.
+type phaseTracker struct {
+	seen map[string]phaseSighting
+}
+
+func newPhaseTracker() *phaseTracker {
+	return &phaseTracker{seen: make(map[string]phaseSighting)}
+}
+
+// observe records a poll of every running operation, forgetting those that
+// are no longer running or have moved to another phase
+func (p *phaseTracker) observe(polled map[string]phaseSighting) {
+	seen := make(map[string]phaseSighting, len(polled))
+	for key, s := range polled {
+		if first, ok := p.seen[key]; ok {
+			s = first
+		}
+		seen[key] = s
+	}
+	p.seen = seen
+}
+
+// estimate returns the percent complete and the time remaining in the
+// phase. The time remaining is empty until the phase has been seen on an
+// earlier poll and has advanced since.
+func (p *phaseTracker) estimate(key string, now, done, total float64) (percent string, eta string) {
+	percent, _ = progressEstimate(0, done, total)
+	first, ok := p.seen[key]
+	if !ok || done <= first.done || now <= first.at {
+		return percent, ""
+	}
+	elapsed := time.Duration((now - first.at) * float64(time.Second))
+	_, eta = progressEstimate(elapsed, done-first.done, total-first.done)
+	return percent, eta
+}
+
+func progressReport(tracker *phaseTracker) (*report, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version < 90600 {
+		return nil, fmt.Errorf("progress reporting needs PostgreSQL 9.6 or later")
+	}
+	rows, err := db.Query(progressQuery(version))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := &report{Header: []string{"Pid", "Operation", "Relation", "Phase", "Percent", "Elapsed", "PhaseETA"}}
+	polled := make(map[string]phaseSighting)
+	for rows.Next() {
+		var (
+			pid                        int
+			operation, relation, phase string
+			done, total, seconds       sql.NullFloat64
+			started                    string
+			now                        float64
+		)
+		err := rows.Scan(&pid, &operation, &relation, &phase, &done, &total, &seconds, &started, &now)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.Join([]string{strconv.Itoa(pid), started, operation, relation, phase}, "\x00")
+		polled[key] = phaseSighting{at: now, done: done.Float64}
+		elapsed := time.Duration(seconds.Float64 * float64(time.Second))
+		percent, eta := tracker.estimate(key, now, done.Float64, total.Float64)
+		r.Append([]string{strconv.Itoa(pid), operation, relation, phase, percent,
+			elapsed.Truncate(time.Second).String(), eta})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	tracker.observe(polled)
+	if len(r.Rows) > 0 {
+		r.Notes = append(r.Notes, "Percent and PhaseETA are for the current phase only; "+
+			"PhaseETA is estimated from the progress seen across --watch refreshes")
+	}
+	return r, nil
+}
+
+func progressCmd(ctx *cli.Context) error {
+	tracker := newPhaseTracker()
+	return runReport(ctx, func() (*report, error) {
+		return progressReport(tracker)
+	})
+}
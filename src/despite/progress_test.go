@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressEstimate(t *testing.T) {
+	cases := []struct {
+		elapsed      time.Duration
+		done, total  float64
+		percent, eta string
+	}{
+		{time.Hour, 25, 100, "25.0%", "3h0m0s"},
+		{90 * time.Second, 50, 100, "50.0%", "1m30s"},
+		{time.Minute, 0, 100, "0.0%", ""},
+		{time.Minute, 10, 0, "", ""},
+	}
+	for _, c := range cases {
+		percent, eta := progressEstimate(c.elapsed, c.done, c.total)
+		if percent != c.percent || eta != c.eta {
+			t.Errorf("progressEstimate(%s, %v, %v) = %q, %q; expected %q, %q",
+				c.elapsed, c.done, c.total, percent, eta, c.percent, c.eta)
+		}
+	}
+}
+
+func TestProgressQueryOnlyUsesExistingViews(t *testing.T) {
+	q := progressQuery(100000)
+	if !strings.Contains(q, "pg_stat_progress_vacuum") || strings.Contains(q, "pg_stat_progress_create_index") {
+		t.Errorf("unexpected views for PostgreSQL 10:\n%s", q)
+	}
+	if q := progressQuery(160000); !strings.Contains(q, "pg_stat_progress_copy") {
+		t.Errorf("expected pg_stat_progress_copy for PostgreSQL 16:\n%s", q)
+	}
+}
+
+func TestPhaseTrackerEstimatesWithinPhase(t *testing.T) {
+	tracker := newPhaseTracker()
+	// the command has run for an hour, but the phase has only just been seen
+	if percent, eta := tracker.estimate("42 scanning heap", 3600, 50, 100); percent != "50.0%" || eta != "" {
+		t.Errorf("first poll is %q, %q; expected 50.0%% and no ETA", percent, eta)
+	}
+	tracker.observe(map[string]phaseSighting{"42 scanning heap": {at: 3600, done: 50}})
+	tracker.observe(map[string]phaseSighting{"42 scanning heap": {at: 3610, done: 60}})
+	if _, eta := tracker.estimate("42 scanning heap", 3610, 60, 100); eta != "40s" {
+		t.Errorf("ETA is %q, expected 40s from 10 blocks in 10 seconds", eta)
+	}
+	// moving to the next phase starts over
+	tracker.observe(map[string]phaseSighting{"42 vacuuming indexes": {at: 3620, done: 0}})
+	if _, eta := tracker.estimate("42 vacuuming indexes", 3620, 0, 100); eta != "" {
+		t.Errorf("ETA in a new phase is %q, expected none", eta)
+	}
+	if _, ok := tracker.seen["42 scanning heap"]; ok {
+		t.Error("the finished phase was not forgotten")
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/urfave/cli"
+)
+
+// reaperPolicy selects sessions to cancel or terminate. Empty fields match
+// any session; OlderThan is how long the session has been in its state.
+type reaperPolicy struct {
+	Name        string
+	Role        string
+	Application string
+	Database    string
+	State       string
+	OlderThan   time.Duration
+	Action      string
+}
+
+// reaperSession is a row of pg_stat_activity. Only client backends are
+// ever reaped; walsenders and logical replication workers stay active for
+// days and must not match a policy on state and age alone.
+type reaperSession struct {
+	Pid         int
+	BackendType string
+	Role        string
+	Application string
+	Database    string
+	State       string
+	InState     time.Duration
+	StateChange string
+	Query       string
+}
+
+func (p reaperPolicy) matches(s reaperSession) bool {
+	return (p.Role == "" || p.Role == s.Role) &&
+		(p.Application == "" || p.Application == s.Application) &&
+		(p.Database == "" || p.Database == s.Database) &&
+		(p.State == "" || p.State == s.State) &&
+		s.InState > p.OlderThan
+}
+
+// reaperPolicies reads policies from the config file, which looks like:
+//
+//	reaper:
+//	  policies:
+//	    - name: stuck-app-transactions
+//	      role: app_rw
+//	      state: idle in transaction
+//	      older-than: 10m
+//	      action: terminate
+//	    - name: metabase
+//	      application: metabase
+//	      state: active
+//	      older-than: 30m
+//	      action: cancel
+func reaperPolicies(cfg *config.Config) ([]reaperPolicy, error) {
+	var policies []reaperPolicy
+	for i := range cfg.UList("reaper.policies") {
+		c, err := cfg.Get(fmt.Sprintf("reaper.policies.%d", i))
+		if err != nil {
+			return nil, err
+		}
+		p := reaperPolicy{
+			Name:        c.UString("name", fmt.Sprintf("policy %d", i+1)),
+			Role:        c.UString("role"),
+			Application: c.UString("application"),
+			Database:    c.UString("database"),
+			State:       c.UString("state"),
+			Action:      c.UString("action", "cancel"),
+		}
+		olderThan, err := c.String("older-than")
+		if err != nil {
+			return nil, fmt.Errorf("%s: older-than is required", p.Name)
+		}
+		if p.OlderThan, err = time.ParseDuration(olderThan); err != nil {
+			return nil, fmt.Errorf("%s: %s", p.Name, err)
+		}
+		if p.Action != "cancel" && p.Action != "terminate" {
+			return nil, fmt.Errorf("%s: action must be cancel or terminate, not %q", p.Name, p.Action)
+		}
+		policies = append(policies, p)
+	}
+	if len(policies) == 0 {
+		return nil, fmt.Errorf("no policies under reaper.policies")
+	}
+	return policies, nil
+}
+
+// reaperAction is one line of the audit log
+type reaperAction struct {
+	Time        time.Time `json:"time"`
+	Policy      string    `json:"policy"`
+	Action      string    `json:"action"`
+	Executed    bool      `json:"executed"`
+	Pid         int       `json:"pid"`
+	Role        string    `json:"role"`
+	Application string    `json:"application"`
+	Database    string    `json:"database"`
+	State       string    `json:"state"`
+	InState     string    `json:"in_state"`
+	Query       string    `json:"query"`
+	Result      string    `json:"result"`
+}
+
+// reapTargets pairs each session with the first policy that matches it
+func reapTargets(policies []reaperPolicy, sessions []reaperSession) map[int]reaperPolicy {
+	targets := make(map[int]reaperPolicy)
+	for _, s := range sessions {
+		if s.BackendType != "client backend" {
+			continue
+		}
+		for _, p := range policies {
+			if p.matches(s) {
+				targets[s.Pid] = p
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// backendTypeColumn is backend_type of pg_stat_activity. Before 10 there is
+// no backend_type, and a walsender is recognised by its replication command.
+func backendTypeColumn(version int) string {
+	if version < 100000 {
+		return `CASE WHEN query LIKE 'START_REPLICATION%' THEN 'walsender' ELSE 'client backend' END`
+	}
+	return "backend_type"
+}
+
+// signalQuery sends function to a session only if it is still the client
+// backend that was read, in the same state, so that a session that moved
+// on or a pid reused since is left alone. It returns no row otherwise.
+func signalQuery(function string, version int) string {
+	return `SELECT ` + function + `(pid)
+  FROM pg_stat_activity
+  WHERE pid = $1 AND coalesce(state_change::text, '') = $2
+    AND ` + backendTypeColumn(version) + ` = 'client backend'`
+}
+
+func readReaperSessions(db *sql.DB, version int) ([]reaperSession, error) {
+	rows, err := db.Query(`SELECT pid, ` + backendTypeColumn(version) + `, usename, coalesce(application_name, ''), coalesce(datname, ''),
+    coalesce(state, ''), coalesce(extract(epoch FROM clock_timestamp() - state_change), 0),
+    coalesce(state_change::text, ''), coalesce(query, '')
+  FROM pg_stat_activity
+  WHERE usename IS NOT NULL AND pid <> pg_backend_pid()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []reaperSession
+	for rows.Next() {
+		var s reaperSession
+		var seconds float64
+		err := rows.Scan(&s.Pid, &s.BackendType, &s.Role, &s.Application, &s.Database, &s.State, &seconds, &s.StateChange, &s.Query)
+		if err != nil {
+			return nil, err
+		}
+		s.InState = time.Duration(seconds * float64(time.Second))
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+type reaper struct {
+	db       *sql.DB
+	version  int
+	policies []reaperPolicy
+	execute  bool
+	audit    *json.Encoder
+	output   io.Writer
+	// seen keeps a report-only run from logging the same session every
+	// round, keyed by pid and when it entered its state. Only sessions still
+	// present in the last round are kept.
+	seen map[string]bool
+}
+
+// alreadyReported is true for a session a report-only run logged in the
+// previous round. With --execute a session that is still there was not
+// ended by its signal, so it is signalled again.
+func (r *reaper) alreadyReported(key string) bool {
+	return !r.execute && r.seen[key]
+}
+
+// reap evaluates every policy once against the current sessions
+func (r *reaper) reap() error {
+	sessions, err := readReaperSessions(r.db, r.version)
+	if err != nil {
+		return err
+	}
+	targets := reapTargets(r.policies, sessions)
+	seen := make(map[string]bool)
+	defer func() { r.seen = seen }()
+	for _, s := range sessions {
+		p, ok := targets[s.Pid]
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%d %s", s.Pid, s.StateChange)
+		seen[key] = true
+		if r.alreadyReported(key) {
+			continue
+		}
+		a := reaperAction{
+			Time: time.Now(), Policy: p.Name, Action: p.Action, Executed: r.execute,
+			Pid: s.Pid, Role: s.Role, Application: s.Application, Database: s.Database,
+			State: s.State, InState: s.InState.Round(time.Second).String(), Query: s.Query,
+			Result: "not executed",
+		}
+		if r.execute {
+			function := "pg_cancel_backend"
+			if p.Action == "terminate" {
+				function = "pg_terminate_backend"
+			}
+			var signalled bool
+			err := r.db.QueryRow(signalQuery(function, r.version), s.Pid, s.StateChange).Scan(&signalled)
+			switch {
+			case err == sql.ErrNoRows:
+				a.Result = "session had moved on"
+			case err != nil:
+				a.Result = err.Error()
+			case !signalled:
+				a.Result = "session was gone"
+			default:
+				a.Result = "done"
+			}
+		}
+		fmt.Fprintf(r.output, "%s %-9s pid %d (%s, %s, %s for %s) by policy %s: %s\n",
+			a.Time.Format("15:04:05"), a.Action, a.Pid, a.Role, a.Application, a.State, a.InState, a.Policy, a.Result)
+		if err := r.audit.Encode(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type reaperOptions struct {
+	Config   string
+	AuditLog string
+	Interval time.Duration
+	Execute  bool
+	Once     bool
+}
+
+func runReaper(output io.Writer, opts reaperOptions) error {
+	cfg, err := config.ParseYamlFile(opts.Config)
+	if err != nil {
+		return fmt.Errorf("%s: %s", opts.Config, err)
+	}
+	policies, err := reaperPolicies(cfg)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(opts.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	version, err := serverVersion(db)
+	if err != nil {
+		return err
+	}
+	r := &reaper{db: db, version: version, policies: policies, execute: opts.Execute,
+		audit: json.NewEncoder(f), output: output, seen: make(map[string]bool)}
+	if !opts.Execute {
+		fmt.Fprintln(output, "report only, run with --execute to cancel or terminate sessions")
+	}
+	if opts.Once {
+		return r.reap()
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.reap(); err != nil {
+			// a daemon should outlive a restart of the server it watches
+			fmt.Fprintf(output, "%s %s\n", time.Now().Format("15:04:05"), err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func reaperCmd(ctx *cli.Context) error {
+	opts := reaperOptions{
+		Config:   ctx.String("config"),
+		AuditLog: ctx.String("audit-log"),
+		Interval: ctx.Duration("interval"),
+		Execute:  ctx.Bool("execute"),
+		Once:     ctx.Bool("once"),
+	}
+	if opts.Config == "" {
+		return cli.NewExitError("--config is required", 1)
+	}
+	if err := runReaper(os.Stdout, opts); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
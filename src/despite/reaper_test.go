@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olebedev/config"
+)
+
+func TestReaperPolicies(t *testing.T) {
+	cfg, err := config.ParseYaml(`
+reaper:
+  policies:
+    - name: stuck
+      role: app_rw
+      state: idle in transaction
+      older-than: 10m
+      action: terminate
+    - application: metabase
+      older-than: 30m
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []reaperPolicy{
+		{Name: "stuck", Role: "app_rw", State: "idle in transaction", OlderThan: 10 * time.Minute, Action: "terminate"},
+		{Name: "policy 2", Application: "metabase", OlderThan: 30 * time.Minute, Action: "cancel"},
+	}
+	policies, err := reaperPolicies(cfg)
+	if err != nil || !reflect.DeepEqual(policies, expected) {
+		t.Errorf("policies are %+v (%v), expected %+v", policies, err, expected)
+	}
+
+	cfg, _ = config.ParseYaml("reaper:\n  policies:\n    - role: app\n      older-than: 1m\n      action: kill\n")
+	if _, err := reaperPolicies(cfg); err == nil {
+		t.Errorf("expected an unknown action to be rejected")
+	}
+}
+
+func TestReapTargets(t *testing.T) {
+	policies := []reaperPolicy{
+		{Name: "stuck", Role: "app_rw", State: "idle in transaction", OlderThan: 10 * time.Minute, Action: "terminate"},
+		{Name: "slow", State: "active", OlderThan: 30 * time.Minute, Action: "cancel"},
+	}
+	sessions := []reaperSession{
+		{Pid: 1, BackendType: "client backend", Role: "app_rw", State: "idle in transaction", InState: 11 * time.Minute},
+		{Pid: 2, BackendType: "client backend", Role: "app_rw", State: "idle in transaction", InState: 9 * time.Minute},
+		{Pid: 3, BackendType: "client backend", Role: "metabase", State: "active", InState: time.Hour},
+		{Pid: 4, BackendType: "client backend", Role: "metabase", State: "idle", InState: time.Hour},
+	}
+	targets := reapTargets(policies, sessions)
+	if len(targets) != 2 || targets[1].Name != "stuck" || targets[3].Name != "slow" {
+		t.Errorf("unexpected targets %+v", targets)
+	}
+}
+
+func TestReapTargetsSkipsReplication(t *testing.T) {
+	policies := []reaperPolicy{{Name: "slow", State: "active", OlderThan: 30 * time.Minute, Action: "terminate"}}
+	sessions := []reaperSession{
+		{Pid: 1, BackendType: "walsender", Role: "replicator", State: "active", InState: 72 * time.Hour},
+		{Pid: 2, BackendType: "logical replication worker", Role: "postgres", State: "active", InState: 72 * time.Hour},
+		{Pid: 3, BackendType: "client backend", Role: "app", State: "active", InState: time.Hour},
+	}
+	targets := reapTargets(policies, sessions)
+	if len(targets) != 1 || targets[3].Name != "slow" {
+		t.Errorf("expected only the client backend to be targeted, got %+v", targets)
+	}
+}
+
+func TestReaperRetriesWhenExecuting(t *testing.T) {
+	seen := map[string]bool{"42 2016-09-01 12:00:00+00": true}
+	report := &reaper{seen: seen}
+	if !report.alreadyReported("42 2016-09-01 12:00:00+00") {
+		t.Error("a report-only run logged the same session twice")
+	}
+	execute := &reaper{seen: seen, execute: true}
+	if execute.alreadyReported("42 2016-09-01 12:00:00+00") {
+		t.Error("a session that survived its signal was not signalled again")
+	}
+}
+
+func TestSignalQueryRechecksSession(t *testing.T) {
+	for _, version := range []int{90600, 100000} {
+		q := signalQuery("pg_terminate_backend", version)
+		for _, check := range []string{"pg_terminate_backend(pid)", "pid = $1", "state_change::text, '') = $2", "= 'client backend'"} {
+			if !strings.Contains(q, check) {
+				t.Errorf("signal query for %d does not contain %q:\n%s", version, check, q)
+			}
+		}
+	}
+}
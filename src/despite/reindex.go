@@ -0,0 +1,480 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	reindexNewSuffix = "_despite_new"
+	reindexOldSuffix = "_despite_old"
+	maxIdentifier    = 63
+)
+
+// reindexOptions are the thresholds and limits for pg:reindex.
+// SpaceBudget is the disk headroom the operator vouches for, as free disk
+// space cannot be measured over a connection; it is required to execute.
+type reindexOptions struct {
+	Bloat       float64
+	MinSize     float64
+	SpaceBudget float64
+	LockTimeout time.Duration
+	Journal     string
+	Execute     bool
+}
+
+// reindexTarget is a bloated index chosen for rebuilding
+type reindexTarget struct {
+	Schema     string
+	Name       string
+	Table      string
+	Definition string
+	Size       float64
+	Bloat      float64 // estimated fraction of Size that is bloat
+	Constraint bool
+}
+
+// reindexStep is one statement in rebuilding an index. Steps are recorded
+// in the journal as they complete so an interrupted run can pick up at the
+// first step that has not finished.
+type reindexStep struct {
+	Name      string
+	Statement string
+}
+
+// reindexJournalEntry is one line of the journal file
+type reindexJournalEntry struct {
+	Time   time.Time `json:"time"`
+	Schema string    `json:"schema"`
+	Index  string    `json:"index"`
+	Step   string    `json:"step"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// reindexCandidatesQuery estimates btree bloat by comparing the pages an
+// index uses with the pages its tuples would need when freshly built at
+// the default fillfactor, using the average column widths from pg_stats.
+const reindexCandidatesQuery = `SELECT n.nspname, i.relname, t.relname,
+    pg_get_indexdef(i.oid),
+    i.relpages::float8 * bs.size,
+    greatest(1 - ceil(i.reltuples * (12 + coalesce(w.width, 8)) / (bs.size * 0.9 - 24)) / i.relpages, 0),
+    EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.oid)
+  FROM pg_index x
+    JOIN pg_class i ON i.oid = x.indexrelid
+    JOIN pg_class t ON t.oid = x.indrelid
+    JOIN pg_namespace n ON n.oid = i.relnamespace
+    JOIN pg_am am ON am.oid = i.relam AND am.amname = 'btree'
+    CROSS JOIN (SELECT current_setting('block_size')::float8 AS size) bs
+    LEFT JOIN LATERAL (
+      SELECT sum(s.avg_width) AS width
+        FROM pg_attribute a
+          JOIN pg_stats s ON s.schemaname = n.nspname AND s.tablename = t.relname AND s.attname = a.attname
+       WHERE a.attrelid = t.oid AND a.attnum = ANY (x.indkey)
+    ) w ON true
+  WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+    AND n.nspname !~ '^pg_toast'
+    AND x.indisvalid
+    AND i.relpages > 0
+  ORDER BY i.relpages DESC`
+
+var (
+	indexDefPattern = regexp.MustCompile(`^CREATE (UNIQUE )?INDEX (?:"(?:[^"]|"")*"|\S+) ON `)
+	// REINDEX CONCURRENTLY names its transient indexes <name>_ccnew and
+	// <name>_ccold, with a number added when that name is taken
+	concurrentSuffix = regexp.MustCompile(`_cc(?:new|old)[0-9]*$`)
+)
+
+func (t reindexTarget) qualified(name string) string {
+	return quoteIdent(t.Schema) + "." + quoteIdent(name)
+}
+
+// spaceNeeded estimates the extra space a rebuild uses while the old and
+// new index both exist
+func (t reindexTarget) spaceNeeded() float64 {
+	return t.Size * (1 - t.Bloat) * 1.1
+}
+
+// leftover reports whether name is a transient index of a rebuild of t.
+// PostgreSQL truncates the base name so the suffix fits in an identifier.
+func (t reindexTarget) leftover(name string) bool {
+	if name == t.suffixed(reindexNewSuffix) {
+		return true
+	}
+	loc := concurrentSuffix.FindStringIndex(name)
+	if loc == nil {
+		return false
+	}
+	base := name[:loc[0]]
+	return base == t.Name || len(name) >= maxIdentifier-1 && base != "" && strings.HasPrefix(t.Name, base)
+}
+
+// suffixed appends suffix to the index name, truncating the name so the
+// result still fits in an identifier.
+func (t reindexTarget) suffixed(suffix string) string {
+	name := t.Name
+	if len(name)+len(suffix) > maxIdentifier {
+		name = name[:maxIdentifier-len(suffix)]
+	}
+	return name + suffix
+}
+
+// reindexSteps returns the statements that rebuild t without blocking
+// writes. Before 12 there is no REINDEX CONCURRENTLY, so a copy is built
+// concurrently and swapped in by renaming. That does not work for indexes
+// backing a constraint, which get no steps on older servers.
+func reindexSteps(t reindexTarget, version int) []reindexStep {
+	if version >= 120000 {
+		return []reindexStep{{"reindex", "REINDEX INDEX CONCURRENTLY " + t.qualified(t.Name)}}
+	}
+	if t.Constraint {
+		return nil
+	}
+	create := indexDefPattern.ReplaceAllString(t.Definition,
+		"CREATE ${1}INDEX CONCURRENTLY "+quoteIdent(t.suffixed(reindexNewSuffix))+" ON ")
+	swap := fmt.Sprintf("ALTER INDEX %s RENAME TO %s; ALTER INDEX %s RENAME TO %s",
+		t.qualified(t.Name), quoteIdent(t.suffixed(reindexOldSuffix)),
+		t.qualified(t.suffixed(reindexNewSuffix)), quoteIdent(t.Name))
+	drop := "DROP INDEX CONCURRENTLY IF EXISTS " + t.qualified(t.suffixed(reindexOldSuffix))
+	return []reindexStep{{"create", create}, {"swap", swap}, {"drop", drop}}
+}
+
+func planReindex(db *sql.DB, opts reindexOptions) ([]reindexTarget, error) {
+	rows, err := db.Query(reindexCandidatesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var targets []reindexTarget
+	for rows.Next() {
+		var t reindexTarget
+		err := rows.Scan(&t.Schema, &t.Name, &t.Table, &t.Definition, &t.Size, &t.Bloat, &t.Constraint)
+		if err != nil {
+			return nil, err
+		}
+		if t.Size >= opts.MinSize && t.Bloat >= opts.Bloat {
+			targets = append(targets, t)
+		}
+	}
+	return targets, rows.Err()
+}
+
+// readReindexJournal returns the steps journaled for each index, keyed by
+// schema and index name, and true for the steps that completed. A step
+// that started but never completed maps to false. A missing journal means
+// nothing has been done.
+func readReindexJournal(filename string) (map[string]map[string]bool, []reindexJournalEntry, error) {
+	completed := make(map[string]map[string]bool)
+	var entries []reindexJournalEntry
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return completed, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e reindexJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		entries = append(entries, e)
+		key := e.Schema + "." + e.Index
+		if completed[key] == nil {
+			completed[key] = make(map[string]bool)
+		}
+		if e.Status == "done" {
+			completed[key][e.Step] = true
+		} else if _, ok := completed[key][e.Step]; !ok {
+			completed[key][e.Step] = false
+		}
+	}
+	return completed, entries, scanner.Err()
+}
+
+// reindexRunner executes steps on a single connection, journaling each one
+type reindexRunner struct {
+	ctx     context.Context
+	conn    *sql.Conn
+	journal *json.Encoder
+	output  io.Writer
+}
+
+func (r *reindexRunner) record(t reindexTarget, step, status string, err error) error {
+	e := reindexJournalEntry{Time: time.Now(), Schema: t.Schema, Index: t.Name, Step: step, Status: status}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	fmt.Fprintf(r.output, "%s %-7s %s.%s %s %s\n", e.Time.Format("15:04:05"), status, t.Schema, t.Name, step, e.Error)
+	return r.journal.Encode(e)
+}
+
+// cleanup drops invalid indexes left behind by a failed concurrent build
+// of t, which would otherwise still be maintained on every write. Only
+// invalid indexes on the same table whose names are t's transient names
+// are dropped.
+func (r *reindexRunner) cleanup(t reindexTarget) {
+	rows, err := r.conn.QueryContext(r.ctx, `SELECT i.relname
+  FROM pg_index x
+    JOIN pg_class i ON i.oid = x.indexrelid
+  WHERE NOT x.indisvalid
+    AND x.indrelid = (SELECT indrelid FROM pg_index WHERE indexrelid = $1::regclass)`, t.qualified(t.Name))
+	if err != nil {
+		fmt.Fprintf(r.output, "could not look for invalid indexes: %s\n", err)
+		return
+	}
+	var leftovers []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil && t.leftover(name) {
+			leftovers = append(leftovers, name)
+		}
+	}
+	rows.Close()
+	for _, name := range leftovers {
+		statement := "DROP INDEX CONCURRENTLY IF EXISTS " + t.qualified(name)
+		_, err := r.conn.ExecContext(r.ctx, statement)
+		r.record(reindexTarget{Schema: t.Schema, Name: name}, "cleanup", statusFor(err), err)
+	}
+}
+
+func statusFor(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "done"
+}
+
+// buildsIndex reports whether step builds an index concurrently, leaving
+// an invalid index behind when it does not finish
+func (s reindexStep) buildsIndex() bool {
+	return s.Name == "reindex" || s.Name == "create"
+}
+
+// interrupted reports whether step was started by an earlier run that
+// never completed it, because it failed or the process was killed
+func (s reindexStep) interrupted(completed map[string]bool) bool {
+	done, started := completed[s.Name]
+	return started && !done
+}
+
+// rebuild runs the steps of t that are not already complete. An index
+// build interrupted in an earlier run is cleaned up before it is retried.
+func (r *reindexRunner) rebuild(t reindexTarget, steps []reindexStep, completed map[string]bool) error {
+	for _, step := range steps {
+		if completed[step.Name] {
+			continue
+		}
+		if step.buildsIndex() && step.interrupted(completed) {
+			r.cleanup(t)
+		}
+		if err := r.record(t, step.Name, "started", nil); err != nil {
+			return err
+		}
+		_, err := r.conn.ExecContext(r.ctx, step.Statement)
+		if jerr := r.record(t, step.Name, statusFor(err), err); jerr != nil {
+			return jerr
+		}
+		if err != nil {
+			if step.buildsIndex() {
+				r.cleanup(t)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func reindexPlanReport(targets []reindexTarget, version int, opts reindexOptions,
+	completed map[string]map[string]bool) *report {
+	r := &report{Header: []string{"Index", "Table", "Size", "Bloat", "SpaceNeeded", "Action"}}
+	for _, t := range targets {
+		action := "rebuild"
+		steps := reindexSteps(t, version)
+		switch {
+		case steps == nil:
+			action = "skip: backs a constraint, needs PostgreSQL 12+"
+		case len(completed[t.Schema+"."+t.Name]) > 0:
+			action = "resume"
+		case opts.SpaceBudget > 0 && t.spaceNeeded() > opts.SpaceBudget:
+			action = "skip: needs more than --space-budget"
+		case opts.Execute && opts.SpaceBudget <= 0:
+			action = "skip: --space-budget not given"
+		}
+		r.Append([]string{t.Schema + "." + t.Name, t.Table, prettyBytes(t.Size),
+			fmt.Sprintf("%.0f%%", 100*t.Bloat), prettyBytes(t.spaceNeeded()), action})
+	}
+	return r
+}
+
+// resumeTargets adds indexes from the journal that were part way through
+// a rebuild but no longer look bloated, because the new index was already
+// swapped in and only the old one still needs dropping.
+func resumeTargets(targets []reindexTarget, completed map[string]map[string]bool,
+	entries []reindexJournalEntry) []reindexTarget {
+	planned := make(map[string]bool)
+	for _, t := range targets {
+		planned[t.Schema+"."+t.Name] = true
+	}
+	for _, e := range entries {
+		key := e.Schema + "." + e.Index
+		if planned[key] || !completed[key]["create"] || completed[key]["drop"] {
+			continue
+		}
+		planned[key] = true
+		targets = append(targets, reindexTarget{Schema: e.Schema, Name: e.Index})
+	}
+	return targets
+}
+
+// pendingReindex is the targets, including ones resumed from the journal,
+// whose rebuild has not finished in the run the journal belongs to
+func pendingReindex(targets []reindexTarget, completed map[string]map[string]bool,
+	entries []reindexJournalEntry) []reindexTarget {
+	var pending []reindexTarget
+	for _, t := range resumeTargets(targets, completed, entries) {
+		done := completed[t.Schema+"."+t.Name]
+		if !done["reindex"] && !done["drop"] {
+			pending = append(pending, t)
+		}
+	}
+	return pending
+}
+
+// finishReindexJournal removes the journal once a run has rebuilt every
+// index it set out to, so the next run starts afresh instead of skipping
+// indexes that have bloated again since.
+func finishReindexJournal(filename string) error {
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func reindex(output io.Writer, opts reindexOptions) error {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	version, err := serverVersion(db)
+	if err != nil {
+		return err
+	}
+	completed, entries, err := readReindexJournal(opts.Journal)
+	if err != nil {
+		return err
+	}
+	targets, err := planReindex(db, opts)
+	if err != nil {
+		return err
+	}
+	pending := pendingReindex(targets, completed, entries)
+	if len(pending) == 0 {
+		fmt.Fprintln(output, "no indexes need rebuilding")
+		return nil
+	}
+	renderReport(output, reindexPlanReport(pending, version, opts, completed))
+	if !opts.Execute {
+		fmt.Fprintln(output, "\nthis is the plan only, run again with --execute and --space-budget set to "+
+			"the free disk space to rebuild these indexes")
+		return nil
+	}
+	if opts.SpaceBudget <= 0 {
+		return fmt.Errorf("--execute needs --space-budget, the free disk space a rebuild may use; " +
+			"it cannot be measured over a connection")
+	}
+
+	f, err := os.OpenFile(opts.Journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	timeout := fmt.Sprintf("SET lock_timeout = %d", opts.LockTimeout/time.Millisecond)
+	if _, err := conn.ExecContext(ctx, timeout); err != nil {
+		return err
+	}
+	runner := &reindexRunner{ctx: ctx, conn: conn, journal: json.NewEncoder(f), output: output}
+	fmt.Fprintf(output, "\njournaling to %s, run the same command again to resume\n", opts.Journal)
+	failed := 0
+	for _, t := range pending {
+		steps := reindexSteps(t, version)
+		if steps == nil || t.spaceNeeded() > opts.SpaceBudget {
+			continue
+		}
+		if err := runner.rebuild(t, steps, completed[t.Schema+"."+t.Name]); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d indexes could not be rebuilt, see %s", failed, opts.Journal)
+	}
+	f.Close()
+	return finishReindexJournal(opts.Journal)
+}
+
+// parseSize parses sizes like "500MB" or "20 GB" into bytes
+func parseSize(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	value, _, ok := parseQuantity(strings.TrimSpace(s))
+	if !ok {
+		return 0, fmt.Errorf("could not parse size %q, use a number with kB, MB, GB or TB", s)
+	}
+	return value, nil
+}
+
+func reindexCmd(ctx *cli.Context) error {
+	opts := reindexOptions{
+		Bloat:       ctx.Float64("bloat"),
+		LockTimeout: ctx.Duration("lock-timeout"),
+		Journal:     ctx.String("journal"),
+		Execute:     ctx.Bool("execute"),
+	}
+	var err error
+	if opts.MinSize, err = parseSize(ctx.String("min-size")); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	if opts.SpaceBudget, err = parseSize(ctx.String("space-budget")); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	err = reindex(os.Stdout, opts)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
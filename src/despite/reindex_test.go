@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReindexSteps(t *testing.T) {
+	target := reindexTarget{
+		Schema:     "public",
+		Name:       "users_email_idx",
+		Definition: "CREATE UNIQUE INDEX users_email_idx ON public.users USING btree (email)",
+	}
+	expected := []reindexStep{{"reindex", `REINDEX INDEX CONCURRENTLY "public"."users_email_idx"`}}
+	if steps := reindexSteps(target, 120000); !reflect.DeepEqual(steps, expected) {
+		t.Errorf("PostgreSQL 12 steps are %v, expected %v", steps, expected)
+	}
+	expected = []reindexStep{
+		{"create", `CREATE UNIQUE INDEX CONCURRENTLY "users_email_idx_despite_new" ON public.users USING btree (email)`},
+		{"swap", `ALTER INDEX "public"."users_email_idx" RENAME TO "users_email_idx_despite_old"; ` +
+			`ALTER INDEX "public"."users_email_idx_despite_new" RENAME TO "users_email_idx"`},
+		{"drop", `DROP INDEX CONCURRENTLY IF EXISTS "public"."users_email_idx_despite_old"`},
+	}
+	if steps := reindexSteps(target, 110000); !reflect.DeepEqual(steps, expected) {
+		t.Errorf("PostgreSQL 11 steps are %v, expected %v", steps, expected)
+	}
+	target.Constraint = true
+	if steps := reindexSteps(target, 110000); steps != nil {
+		t.Errorf("constraint indexes cannot be swapped before 12, got %v", steps)
+	}
+}
+
+func TestResumeTargetsFinishesSwappedIndexes(t *testing.T) {
+	entries := []reindexJournalEntry{
+		{Schema: "public", Index: "a_idx", Step: "create", Status: "done"},
+		{Schema: "public", Index: "a_idx", Step: "swap", Status: "done"},
+		{Schema: "public", Index: "b_idx", Step: "create", Status: "done"},
+		{Schema: "public", Index: "b_idx", Step: "swap", Status: "done"},
+		{Schema: "public", Index: "b_idx", Step: "drop", Status: "done"},
+	}
+	completed := map[string]map[string]bool{
+		"public.a_idx": {"create": true, "swap": true},
+		"public.b_idx": {"create": true, "swap": true, "drop": true},
+	}
+	targets := resumeTargets(nil, completed, entries)
+	expected := []reindexTarget{{Schema: "public", Name: "a_idx"}}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("resumed targets are %v, expected %v", targets, expected)
+	}
+}
+
+func TestReindexLeftover(t *testing.T) {
+	target := reindexTarget{Schema: "public", Name: "users_email_idx"}
+	long := reindexTarget{Schema: "public", Name: strings.Repeat("x", 63)}
+	cases := []struct {
+		target   reindexTarget
+		name     string
+		leftover bool
+	}{
+		{target, "users_email_idx_ccnew", true},
+		{target, "users_email_idx_ccnew1", true},
+		{target, "users_email_idx_ccold", true},
+		{target, "users_email_idx_despite_new", true},
+		{target, "users_email_idx", false},
+		{target, "users_email_idx2_ccnew", false},
+		{target, "users_email_ccnew", false},
+		{long, strings.Repeat("x", 57) + "_ccold", true},
+		{long, strings.Repeat("x", 56) + "_ccold1", true},
+	}
+	for _, c := range cases {
+		if leftover := c.target.leftover(c.name); leftover != c.leftover {
+			t.Errorf("%s leftover of %s is %v, expected %v", c.name, c.target.Name, leftover, c.leftover)
+		}
+	}
+}
+
+// TestReindexRunTwice checks that an index rebuilt by a completed run is
+// rebuilt again by the next one, while an interrupted run is resumed.
+func TestReindexRunTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "despite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "despite-reindex.journal")
+	targets := []reindexTarget{{Schema: "public", Name: "a_idx"}}
+	run := func() []reindexTarget {
+		completed, entries, err := readReindexJournal(journal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pendingReindex(targets, completed, entries)
+	}
+
+	if pending := run(); !reflect.DeepEqual(pending, targets) {
+		t.Fatalf("first run pending %v, expected %v", pending, targets)
+	}
+	f, err := os.Create(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	for _, status := range []string{"started", "done"} {
+		enc.Encode(reindexJournalEntry{Time: time.Now(), Schema: "public", Index: "a_idx", Step: "reindex", Status: status})
+	}
+	f.Close()
+	// interrupted before the run finished, so the rebuild is not repeated
+	if pending := run(); len(pending) != 0 {
+		t.Errorf("resumed run pending %v, expected nothing", pending)
+	}
+	if err := finishReindexJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+	if pending := run(); !reflect.DeepEqual(pending, targets) {
+		t.Errorf("second run pending %v, expected %v", pending, targets)
+	}
+}
+
+func TestReindexInterruptedStep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "despite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "despite-reindex.journal")
+	f, err := os.Create(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	// a_idx was killed mid-build, b_idx failed and was retried successfully
+	enc.Encode(reindexJournalEntry{Schema: "public", Index: "a_idx", Step: "create", Status: "started"})
+	enc.Encode(reindexJournalEntry{Schema: "public", Index: "b_idx", Step: "reindex", Status: "started"})
+	enc.Encode(reindexJournalEntry{Schema: "public", Index: "b_idx", Step: "reindex", Status: "failed"})
+	enc.Encode(reindexJournalEntry{Schema: "public", Index: "b_idx", Step: "reindex", Status: "started"})
+	enc.Encode(reindexJournalEntry{Schema: "public", Index: "b_idx", Step: "reindex", Status: "done"})
+	f.Close()
+	completed, _, err := readReindexJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := reindexStep{Name: "create"}
+	if !create.interrupted(completed["public.a_idx"]) {
+		t.Error("the killed build of a_idx is not seen as interrupted")
+	}
+	if (reindexStep{Name: "swap"}).interrupted(completed["public.a_idx"]) {
+		t.Error("a step that never started is seen as interrupted")
+	}
+	if (reindexStep{Name: "reindex"}).interrupted(completed["public.b_idx"]) {
+		t.Error("the completed rebuild of b_idx is seen as interrupted")
+	}
+}
+
+func TestReindexPlanNeedsSpaceBudget(t *testing.T) {
+	targets := []reindexTarget{
+		{Schema: "public", Name: "a_idx", Size: 100 << 20, Bloat: 0.5},
+		{Schema: "public", Name: "b_idx", Size: 10 << 20, Bloat: 0.5},
+	}
+	actions := func(opts reindexOptions) []string {
+		var a []string
+		for _, row := range reindexPlanReport(targets, 120000, opts, nil).Rows {
+			a = append(a, row[5])
+		}
+		return a
+	}
+	if a := actions(reindexOptions{Execute: true}); a[0] != "skip: --space-budget not given" {
+		t.Errorf("actions without a budget are %v", a)
+	}
+	expected := []string{"skip: needs more than --space-budget", "rebuild"}
+	if a := actions(reindexOptions{Execute: true, SpaceBudget: 20 << 20}); !reflect.DeepEqual(a, expected) {
+		t.Errorf("actions with a 20 MB budget are %v, expected %v", a, expected)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// report is the tabular result of a diagnostic command. Commands build a
+// report instead of writing to a tablewriter directly so that generic
+// features like --watch can compare one run with the next.
+// Key lists the columns that together identify a row between runs, the
+// first column when empty. Notes are printed after the table, for
+// interpretation that does not fit in a cell.
+type report struct {
+	Header []string   `json:"header"`
+	Rows   [][]string `json:"rows"`
+	Notes  []string   `json:"notes,omitempty"`
+	Key    []int      `json:"-"`
+}
+
+// rowKey is the identity of row within r, as named by r.Key
+func (r *report) rowKey(row []string) string {
+	key := r.Key
+	if len(key) == 0 {
+		key = []int{0}
+	}
+	parts := make([]string, len(key))
+	for i, column := range key {
+		if column < len(row) {
+			parts[i] = row[column]
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// isKey reports whether column is part of the row identity
+func (r *report) isKey(column int) bool {
+	if len(r.Key) == 0 {
+		return column == 0
+	}
+	for _, k := range r.Key {
+		if k == column {
+			return true
+		}
+	}
+	return false
+}
+
+// reportFunc produces a fresh report each time it is called
+type reportFunc func() (*report, error)
+
+// Append adds a row to the report
+func (r *report) Append(row []string) {
+	r.Rows = append(r.Rows, row)
+}
+
+// renderReport writes the report as a borderless table
+func renderReport(output io.Writer, r *report) {
+	table := tablewriter.NewWriter(output)
+	table.SetHeader(r.Header)
+	table.SetBorder(false)
+	table.AppendBulk(r.Rows)
+	table.Render()
+	if len(r.Notes) > 0 {
+		fmt.Fprintln(output)
+	}
+	for _, note := range r.Notes {
+		fmt.Fprintf(output, "* %s\n", note)
+	}
+}
+
+// queryReport runs query and returns every column as text, using the
+// column names as the header. NULLs become empty strings.
+func queryReport(db *sql.DB, query string, args ...interface{}) (*report, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	r := &report{Header: columns}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(values))
+		for i, v := range values {
+			row[i] = v.String
+		}
+		r.Append(row)
+	}
+	return r, rows.Err()
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// roleInfo is a role as seen in pg_roles, plus its password hash when we
+// are allowed to read pg_authid.
+type roleInfo struct {
+	Name         string
+	Super        bool
+	CreateRole   bool
+	Replication  bool
+	BypassRLS    bool
+	Login        bool
+	ValidUntil   sql.NullString
+	Expired      bool
+	Password     sql.NullString
+	HashReadable bool
+	Active       bool
+}
+
+// neverExpires reports whether the password has no expiry: VALID UNTIL was
+// never set, or was set to 'infinity'
+func (r roleInfo) neverExpires() bool {
+	return !r.ValidUntil.Valid || r.ValidUntil.String == "infinity"
+}
+
+// roleFindings audits the attributes and password of a single role
+func roleFindings(r roleInfo, activityKnown bool) []finding {
+	var findings []finding
+	add := func(s severity, format string, args ...interface{}) {
+		findings = append(findings, finding{s, r.Name, fmt.Sprintf(format, args...)})
+	}
+	if r.Super {
+		add(severityHigh, "superuser")
+	}
+	if r.BypassRLS && !r.Super {
+		add(severityHigh, "can bypass row level security")
+	}
+	if r.CreateRole && !r.Super {
+		add(severityMedium, "can create roles, and so grant itself membership in most others")
+	}
+	if r.Replication && !r.Super {
+		add(severityMedium, "can start replication and read every table through it")
+	}
+	if !r.Login {
+		return findings
+	}
+	if r.HashReadable {
+		switch {
+		case !r.Password.Valid:
+			add(severityMedium, "login role with no password, access depends entirely on pg_hba.conf")
+		case strings.HasPrefix(r.Password.String, "md5"):
+			add(severityMedium, "password is an MD5 hash, reset it with password_encryption = scram-sha-256")
+		case !strings.HasPrefix(r.Password.String, "SCRAM-SHA-256$"):
+			add(severityHigh, "password is stored unhashed")
+		}
+	}
+	switch {
+	case r.Expired:
+		add(severityLow, "password expired at %s", r.ValidUntil.String)
+	case r.neverExpires() && (!r.HashReadable || r.Password.Valid):
+		add(severityLow, "password never expires")
+	}
+	if activityKnown && !r.Active {
+		add(severityLow, "no activity recorded since statistics were reset, the role may be unused")
+	}
+	return findings
+}
+
+func readRoles(db *sql.DB) ([]roleInfo, error) {
+	rows, err := db.Query(`SELECT rolname, rolsuper, rolcreaterole, rolreplication, rolbypassrls,
+    rolcanlogin, rolvaliduntil::text, coalesce(rolvaliduntil < now(), false)
+  FROM pg_roles
+  WHERE rolname !~ '^pg_'
+  ORDER BY rolname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []roleInfo
+	for rows.Next() {
+		var r roleInfo
+		err := rows.Scan(&r.Name, &r.Super, &r.CreateRole, &r.Replication, &r.BypassRLS,
+			&r.Login, &r.ValidUntil, &r.Expired)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+// readPasswordHashes returns rolpassword by role name. pg_authid is only
+// readable by superusers, so ok is false for everyone else.
+func readPasswordHashes(db *sql.DB) (hashes map[string]sql.NullString, ok bool) {
+	rows, err := db.Query("SELECT rolname, rolpassword FROM pg_authid")
+	if err != nil {
+		return nil, false
+	}
+	defer rows.Close()
+	hashes = make(map[string]sql.NullString)
+	for rows.Next() {
+		var name string
+		var password sql.NullString
+		if err := rows.Scan(&name, &password); err != nil {
+			return nil, false
+		}
+		hashes[name] = password
+	}
+	return hashes, rows.Err() == nil
+}
+
+// readActiveRoles returns roles that are connected now or have statements
+// in pg_stat_statements. Postgres does not record logins, so this is the
+// best evidence of activity available. ok is false without the extension.
+func readActiveRoles(db *sql.DB) (active map[string]bool, ok bool) {
+	rows, err := db.Query(`SELECT DISTINCT r.rolname
+  FROM pg_roles r
+  WHERE r.oid IN (SELECT userid FROM pg_stat_statements)
+     OR r.rolname IN (SELECT usename FROM pg_stat_activity WHERE usename IS NOT NULL)`)
+	if err != nil {
+		return nil, false
+	}
+	defer rows.Close()
+	active = make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, false
+		}
+		active[name] = true
+	}
+	return active, rows.Err() == nil
+}
+
+// securityDefinerFindings reports SECURITY DEFINER functions that do not
+// pin search_path, which lets a caller substitute their own objects and
+// run them with the owner's privileges.
+func securityDefinerFindings(db *sql.DB) ([]finding, error) {
+	rows, err := db.Query(`SELECT p.oid::regprocedure::text, r.rolname, r.rolsuper
+  FROM pg_proc p
+    JOIN pg_namespace n ON n.oid = p.pronamespace
+    JOIN pg_roles r ON r.oid = p.proowner
+  WHERE p.prosecdef
+    AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+    AND NOT EXISTS (
+      SELECT 1 FROM unnest(coalesce(p.proconfig, '{}')) AS c WHERE c LIKE 'search_path=%'
+    )
+  ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var findings []finding
+	for rows.Next() {
+		var function, owner string
+		var super bool
+		if err := rows.Scan(&function, &owner, &super); err != nil {
+			return nil, err
+		}
+		s := severityMedium
+		if super {
+			s = severityHigh
+		}
+		findings = append(findings, finding{s, owner,
+			fmt.Sprintf("SECURITY DEFINER function %s does not set search_path", function)})
+	}
+	return findings, rows.Err()
+}
+
+func rolesReport() (*report, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	roles, err := readRoles(db)
+	if err != nil {
+		return nil, err
+	}
+	hashes, hashesReadable := readPasswordHashes(db)
+	active, activityKnown := readActiveRoles(db)
+	var findings []finding
+	for _, r := range roles {
+		if hashesReadable {
+			r.Password, r.HashReadable = hashes[r.Name], true
+		}
+		r.Active = active[r.Name]
+		findings = append(findings, roleFindings(r, activityKnown)...)
+	}
+	definers, err := securityDefinerFindings(db)
+	if err != nil {
+		return nil, err
+	}
+	findings = append(findings, definers...)
+	r := findingsReport("Role", findings)
+	r.Notes = append(r.Notes, fmt.Sprintf("audited %d roles at %s", len(roles), time.Now().Format(time.RFC3339)))
+	if !hashesReadable {
+		r.Notes = append(r.Notes, "password hashes were not checked, pg_authid is only readable by superusers")
+	}
+	if !activityKnown {
+		r.Notes = append(r.Notes, "role activity was not checked, it needs the pg_stat_statements extension")
+	}
+	return r, nil
+}
+
+func rolesCmd(ctx *cli.Context) error {
+	return runReport(ctx, rolesReport)
+}
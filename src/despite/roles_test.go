@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestRoleFindings(t *testing.T) {
+	role := roleInfo{
+		Name:         "app",
+		CreateRole:   true,
+		Login:        true,
+		Password:     sql.NullString{String: "md5abcdef", Valid: true},
+		HashReadable: true,
+	}
+	expected := []finding{
+		{severityMedium, "app", "can create roles, and so grant itself membership in most others"},
+		{severityMedium, "app", "password is an MD5 hash, reset it with password_encryption = scram-sha-256"},
+		{severityLow, "app", "password never expires"},
+		{severityLow, "app", "no activity recorded since statistics were reset, the role may be unused"},
+	}
+	if findings := roleFindings(role, true); !reflect.DeepEqual(findings, expected) {
+		t.Errorf("findings are %v, expected %v", findings, expected)
+	}
+
+	role = roleInfo{
+		Name:         "reporting",
+		Login:        true,
+		Password:     sql.NullString{String: "SCRAM-SHA-256$4096:salt$key:key", Valid: true},
+		HashReadable: true,
+		ValidUntil:   sql.NullString{String: "2030-01-01 00:00:00+00", Valid: true},
+		Active:       true,
+	}
+	if findings := roleFindings(role, true); len(findings) != 0 {
+		t.Errorf("expected no findings, got %v", findings)
+	}
+
+	role.ValidUntil = sql.NullString{String: "infinity", Valid: true}
+	expected = []finding{{severityLow, "reporting", "password never expires"}}
+	if findings := roleFindings(role, true); !reflect.DeepEqual(findings, expected) {
+		t.Errorf("findings for valid until infinity are %v, expected %v", findings, expected)
+	}
+}
+
+func TestFindingsReportOrdersBySeverity(t *testing.T) {
+	r := findingsReport("Role", []finding{
+		{severityLow, "a", "low"},
+		{severityHigh, "b", "high"},
+		{severityLow, "c", "also low"},
+	})
+	expected := [][]string{
+		{"HIGH", "b", "high"},
+		{"LOW", "a", "low"},
+		{"LOW", "c", "also low"},
+	}
+	if !reflect.DeepEqual(r.Rows, expected) {
+		t.Errorf("rows are %v, expected %v", r.Rows, expected)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// userObjects filters out system schemas, and notExtensionMember objects
+// created by CREATE EXTENSION, which are compared as extensions instead.
+const (
+	userSchemas        = `n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname !~ '^pg_'`
+	notExtensionMember = `NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = %s AND d.deptype = 'e')`
+)
+
+// catalogKind is one kind of schema object, and a query returning a key
+// that identifies each object and a definition to compare.
+type catalogKind struct {
+	Name  string
+	Query string
+}
+
+var catalogKinds = []catalogKind{
+	{"schema", `SELECT quote_ident(n.nspname), pg_get_userbyid(n.nspowner)
+    FROM pg_namespace n WHERE ` + userSchemas},
+	{"extension", `SELECT quote_ident(extname), extversion FROM pg_extension`},
+	{"table", `SELECT format('%I.%I', n.nspname, c.relname),
+      CASE c.relpersistence WHEN 'u' THEN 'unlogged ' ELSE '' END ||
+      CASE c.relkind WHEN 'p' THEN 'partitioned table' WHEN 'f' THEN 'foreign table' ELSE 'table' END
+    FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE c.relkind IN ('r', 'p', 'f') AND ` + userSchemas + ` AND ` + fmt.Sprintf(notExtensionMember, "c.oid")},
+	{"column", `SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname),
+      format_type(a.atttypid, a.atttypmod) ||
+      CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END ||
+      coalesce(' DEFAULT ' || pg_get_expr(ad.adbin, ad.adrelid), '')
+    FROM pg_attribute a
+      JOIN pg_class c ON c.oid = a.attrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      LEFT JOIN pg_attrdef ad ON ad.adrelid = a.attrelid AND ad.adnum = a.attnum
+    WHERE a.attnum > 0 AND NOT a.attisdropped
+      AND c.relkind IN ('r', 'p', 'f', 'v', 'm') AND ` + userSchemas + ` AND ` + fmt.Sprintf(notExtensionMember, "c.oid")},
+	{"index", `SELECT format('%I.%I', n.nspname, i.relname), pg_get_indexdef(i.oid)
+    FROM pg_index x
+      JOIN pg_class i ON i.oid = x.indexrelid
+      JOIN pg_namespace n ON n.oid = i.relnamespace
+    WHERE ` + userSchemas + ` AND ` + fmt.Sprintf(notExtensionMember, "i.oid")},
+	{"constraint", `SELECT format('%I.%I.%I', n.nspname, c.relname, k.conname), pg_get_constraintdef(k.oid)
+    FROM pg_constraint k
+      JOIN pg_class c ON c.oid = k.conrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE ` + userSchemas + ` AND ` + fmt.Sprintf(notExtensionMember, "c.oid")},
+	{"view", `SELECT format('%I.%I', n.nspname, c.relname),
+      CASE c.relkind WHEN 'm' THEN 'materialized ' ELSE '' END || pg_get_viewdef(c.oid)
+    FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE c.relkind IN ('v', 'm') AND ` + userSchemas + ` AND ` + fmt.Sprintf(notExtensionMember, "c.oid")},
+	{"function", `SELECT format('%I.%I(%s)', n.nspname, p.proname, pg_get_function_identity_arguments(p.oid)),
+      'returns ' || coalesce(pg_get_function_result(p.oid), '') || ', body md5 ' || md5(coalesce(p.prosrc, ''))
+    FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace
+    WHERE ` + userSchemas + ` AND ` + fmt.Sprintf(notExtensionMember, "p.oid")},
+}
+
+// readCatalog returns the definition of every object of kind, keyed by name.
+// Whitespace is collapsed so that formatting differences between server
+// versions in deparsed definitions do not show up as changes.
+func readCatalog(db *sql.DB, kind catalogKind) (map[string]string, error) {
+	rows, err := db.Query(kind.Query)
+	if err != nil {
+		return nil, fmt.Errorf("reading %ss: %s", kind.Name, err)
+	}
+	defer rows.Close()
+	objects := make(map[string]string)
+	for rows.Next() {
+		var key string
+		var definition sql.NullString
+		if err := rows.Scan(&key, &definition); err != nil {
+			return nil, err
+		}
+		objects[key] = strings.Join(strings.Fields(definition.String), " ")
+	}
+	return objects, rows.Err()
+}
+
+// diffCatalog compares two sets of objects, appending a row to r for each
+// object that is missing on one side or defined differently.
+func diffCatalog(r *report, kind string, source, target map[string]string) {
+	keys := make([]string, 0, len(source)+len(target))
+	for k := range source {
+		keys = append(keys, k)
+	}
+	for k := range target {
+		if _, ok := source[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, inSource := source[k]
+		t, inTarget := target[k]
+		switch {
+		case !inTarget:
+			r.Append([]string{kind, k, "only in source", s, ""})
+		case !inSource:
+			r.Append([]string{kind, k, "only in target", "", t})
+		case s != t:
+			r.Append([]string{kind, k, "differs", s, t})
+		}
+	}
+}
+
+func schemaDiff(output io.Writer, sourceURI, targetURI string) (int, error) {
+	source, err := sql.Open("postgres", sourceURI)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+	target, err := sql.Open("postgres", targetURI)
+	if err != nil {
+		return 0, err
+	}
+	defer target.Close()
+	r := &report{Header: []string{"Kind", "Object", "Difference", "Source", "Target"}}
+	for _, kind := range catalogKinds {
+		s, err := readCatalog(source, kind)
+		if err != nil {
+			return 0, fmt.Errorf("source: %s", err)
+		}
+		t, err := readCatalog(target, kind)
+		if err != nil {
+			return 0, fmt.Errorf("target: %s", err)
+		}
+		diffCatalog(r, kind.Name, s, t)
+	}
+	if len(r.Rows) == 0 {
+		fmt.Fprintln(output, "schemas match")
+		return 0, nil
+	}
+	renderReport(output, r)
+	return len(r.Rows), nil
+}
+
+func schemaDiffCmd(ctx *cli.Context) error {
+	targetURI := ctx.String("target-dburi")
+	if targetURI == "" {
+		return cli.NewExitError("--target-dburi is required", 1)
+	}
+	differences, err := schemaDiff(os.Stdout, dburi, targetURI)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	if differences > 0 {
+		return cli.NewExitError(fmt.Sprintf("\n%d differences found", differences), 1)
+	}
+	return nil
+}
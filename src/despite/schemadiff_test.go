@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffCatalog(t *testing.T) {
+	source := map[string]string{
+		"public.users.id":    "integer NOT NULL",
+		"public.users.email": "text",
+		"public.users.name":  "text",
+	}
+	target := map[string]string{
+		"public.users.id":      "bigint NOT NULL",
+		"public.users.email":   "text",
+		"public.users.deleted": "boolean DEFAULT false",
+	}
+	r := &report{}
+	diffCatalog(r, "column", source, target)
+	expected := [][]string{
+		{"column", "public.users.deleted", "only in target", "", "boolean DEFAULT false"},
+		{"column", "public.users.id", "differs", "integer NOT NULL", "bigint NOT NULL"},
+		{"column", "public.users.name", "only in source", "text", ""},
+	}
+	if !reflect.DeepEqual(r.Rows, expected) {
+		t.Errorf("differences are %v, expected %v", r.Rows, expected)
+	}
+}
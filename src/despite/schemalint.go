@@ -0,0 +1,172 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/olebedev/config"
+	"github.com/urfave/cli"
+)
+
+// lintRule is one schema-lint check. Query returns the offending object
+// and a message for each finding.
+type lintRule struct {
+	Name     string
+	Severity severity
+	Query    string
+}
+
+// userColumns joins every column of a user table with its table and schema
+const userColumns = `FROM pg_attribute a
+      JOIN pg_class c ON c.oid = a.attrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE a.attnum > 0 AND NOT a.attisdropped
+      AND c.relkind IN ('r', 'p')
+      AND ` + userSchemas
+
+// sequenceColumns adds, for every integer or smallint column filled from a
+// sequence, the sequence as q.seq, the largest value of the column as q.max and how far
+// the sequence has advanced as s.last_value. Rows deleted since do not
+// give that back, so it is read from the sequence itself, through
+// query_to_xml as sequences are relations of their own. Sequences the
+// user cannot read are left out.
+const sequenceColumns = `CROSS JOIN LATERAL (
+        SELECT pg_get_serial_sequence(format('%I.%I', n.nspname, c.relname), a.attname) AS seq,
+          CASE a.atttypid WHEN 'smallint'::regtype THEN 32767 ELSE 2147483647 END AS max
+         WHERE a.atttypid IN ('integer'::regtype, 'smallint'::regtype)
+      ) q
+      CROSS JOIN LATERAL (
+        SELECT (xpath('/row/last_value/text()',
+            query_to_xml('SELECT last_value FROM ' || q.seq, false, true, '')))[1]::text::bigint AS last_value
+         WHERE q.seq IS NOT NULL AND has_sequence_privilege(q.seq, 'SELECT')
+      ) s`
+
+var lintRules = []lintRule{
+	{"no-primary-key", severityMedium, `SELECT format('%I.%I', n.nspname, c.relname),
+      'table has no primary key, which also prevents logical replication of updates and deletes'
+    FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE c.relkind IN ('r', 'p') AND ` + userSchemas + `
+      AND NOT EXISTS (SELECT 1 FROM pg_constraint k WHERE k.conrelid = c.oid AND k.contype = 'p')`},
+	{"timestamp-without-time-zone", severityLow, `SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname),
+      'timestamp without time zone, use timestamptz so values are not ambiguous'
+    ` + userColumns + ` AND a.atttypid = 'timestamp'::regtype`},
+	{"varchar-length", severityInfo, `SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname),
+      format_type(a.atttypid, a.atttypmod) || ', prefer text with a CHECK constraint if a limit is needed'
+    ` + userColumns + ` AND a.atttypid = 'varchar'::regtype AND a.atttypmod > 0`},
+	{"float-money", severityHigh, `SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname),
+      format_type(a.atttypid, a.atttypmod) || ' looks like money, floating point cannot represent it exactly, use numeric'
+    ` + userColumns + ` AND a.atttypid IN ('real'::regtype, 'double precision'::regtype)
+      AND a.attname ~* '(price|amount|cost|total|balance|fee|money|salary|tax|payment|charge)'`},
+	{"serial-integer", severityMedium, `SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname),
+      format_type(a.atttypid, a.atttypmod) || ' generated from sequence ' || q.seq || ', which is at ' ||
+      s.last_value || ' and will run out at ' || q.max || ', use bigint'
+    FROM pg_attribute a
+      JOIN pg_class c ON c.oid = a.attrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      ` + sequenceColumns + `
+    WHERE a.attnum > 0 AND NOT a.attisdropped
+      AND c.relkind IN ('r', 'p')
+      AND ` + userSchemas + `
+      AND s.last_value >= least(1000000, q.max / 2)`},
+	{"reserved-word-column", severityLow, `SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname),
+      'column is named with the reserved word ' || a.attname || ', it must always be quoted'
+    ` + userColumns + ` AND a.attname IN (SELECT word FROM pg_get_keywords() WHERE catcode = 'R')`},
+	{"nullable-foreign-key", severityLow, `SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname),
+      'foreign key column ' || k.conname || ' allows NULL, add NOT NULL unless the reference is optional'
+    FROM pg_constraint k
+      JOIN pg_class c ON c.oid = k.conrelid
+      JOIN pg_namespace n ON n.oid = c.relnamespace
+      JOIN pg_attribute a ON a.attrelid = k.conrelid AND a.attnum = ANY (k.conkey)
+    WHERE k.contype = 'f' AND NOT a.attnotnull AND ` + userSchemas},
+}
+
+// enabledLintRules returns the rules that are not switched off in cfg,
+// which looks like:
+//
+//	schema-lint:
+//	  rules:
+//	    varchar-length: false
+func enabledLintRules(cfg *config.Config) []lintRule {
+	var rules []lintRule
+	for _, rule := range lintRules {
+		if cfg == nil || cfg.UBool("schema-lint.rules."+rule.Name, true) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func runLintRule(db *sql.DB, rule lintRule) ([]finding, error) {
+	rows, err := db.Query(rule.Query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", rule.Name, err)
+	}
+	defer rows.Close()
+	var findings []finding
+	for rows.Next() {
+		var object, message string
+		if err := rows.Scan(&object, &message); err != nil {
+			return nil, err
+		}
+		findings = append(findings, finding{rule.Severity, object, fmt.Sprintf("[%s] %s", rule.Name, message)})
+	}
+	return findings, rows.Err()
+}
+
+// schemaLint runs the enabled rules and returns the number of findings
+func schemaLint(output io.Writer, rules []lintRule) (int, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var findings []finding
+	for _, rule := range rules {
+		f, err := runLintRule(db, rule)
+		if err != nil {
+			return 0, err
+		}
+		findings = append(findings, f...)
+	}
+	if len(findings) == 0 {
+		fmt.Fprintf(output, "%d rules passed\n", len(rules))
+		return 0, nil
+	}
+	renderReport(output, findingsReport("Object", findings))
+	return len(findings), nil
+}
+
+func schemaLintCmd(ctx *cli.Context) error {
+	var cfg *config.Config
+	if filename := ctx.String("config"); filename != "" {
+		var err error
+		cfg, err = config.ParseYamlFile(filename)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %s", filename, err), 1)
+		}
+	}
+	count, err := schemaLint(os.Stdout, enabledLintRules(cfg))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	if count > 0 {
+		return cli.NewExitError(fmt.Sprintf("\n%d findings", count), 1)
+	}
+	return nil
+}
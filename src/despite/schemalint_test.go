@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/olebedev/config"
+)
+
+func TestEnabledLintRules(t *testing.T) {
+	if rules := enabledLintRules(nil); len(rules) != len(lintRules) {
+		t.Errorf("expected all %d rules without a config, got %d", len(lintRules), len(rules))
+	}
+	cfg, err := config.ParseYaml(`
+schema-lint:
+  rules:
+    varchar-length: false
+    no-primary-key: true
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := enabledLintRules(cfg)
+	if len(rules) != len(lintRules)-1 {
+		t.Errorf("expected %d rules, got %d", len(lintRules)-1, len(rules))
+	}
+	for _, rule := range rules {
+		if rule.Name == "varchar-length" {
+			t.Errorf("varchar-length should be disabled")
+		}
+	}
+}
+
+func TestSerialIntegerReadsSequence(t *testing.T) {
+	for _, rule := range lintRules {
+		if rule.Name != "serial-integer" {
+			continue
+		}
+		if strings.Contains(rule.Query, "reltuples") || !strings.Contains(rule.Query, "last_value") {
+			t.Errorf("serial-integer should check the sequence's last_value, not the row count:\n%s", rule.Query)
+		}
+		return
+	}
+	t.Error("no serial-integer rule")
+}
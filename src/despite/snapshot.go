@@ -0,0 +1,310 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// snapshotView describes a cumulative statistics view that pg:snapshot
+// captures. Counters that do not exist on the server version being
+// snapshotted (total_time became total_exec_time in 13, for example) are
+// simply absent from the snapshot and skipped by the diff. Query, when
+// set, is used instead of selecting the whole view; Labels are columns
+// shown next to the key to make it readable, and MinVersion skips views
+// that do not exist before that server version.
+type snapshotView struct {
+	Name       string
+	Query      string
+	Keys       []string
+	Labels     []string
+	Counters   []string
+	MinVersion int
+}
+
+var snapshotViews = []snapshotView{
+	{
+		Name: "pg_stat_user_tables",
+		Keys: []string{"schemaname", "relname"},
+		Counters: []string{"seq_scan", "seq_tup_read", "idx_scan", "idx_tup_fetch",
+			"n_tup_ins", "n_tup_upd", "n_tup_del", "n_tup_hot_upd"},
+	},
+	{
+		Name:     "pg_stat_user_indexes",
+		Keys:     []string{"schemaname", "relname", "indexrelname"},
+		Counters: []string{"idx_scan", "idx_tup_read", "idx_tup_fetch"},
+	},
+	{
+		Name: "pg_statio_user_tables",
+		Keys: []string{"schemaname", "relname"},
+		Counters: []string{"heap_blks_read", "heap_blks_hit", "idx_blks_read", "idx_blks_hit",
+			"toast_blks_read", "toast_blks_hit"},
+	},
+	{
+		Name:     "pg_statio_user_indexes",
+		Keys:     []string{"schemaname", "relname", "indexrelname"},
+		Counters: []string{"idx_blks_read", "idx_blks_hit"},
+	},
+	{
+		Name: "pg_stat_database",
+		Keys: []string{"datname"},
+		Counters: []string{"xact_commit", "xact_rollback", "blks_read", "blks_hit",
+			"tup_returned", "tup_fetched", "tup_inserted", "tup_updated", "tup_deleted",
+			"temp_files", "temp_bytes", "deadlocks"},
+	},
+	{
+		Name: "pg_stat_bgwriter",
+		Counters: []string{"checkpoints_timed", "checkpoints_req", "buffers_checkpoint",
+			"buffers_clean", "maxwritten_clean", "buffers_backend", "buffers_alloc"},
+	},
+	{
+		// checkpoint counters moved here from pg_stat_bgwriter in 17
+		Name: "pg_stat_checkpointer",
+		Counters: []string{"num_timed", "num_requested", "num_done", "restartpoints_timed",
+			"restartpoints_req", "restartpoints_done", "write_time", "sync_time", "buffers_written"},
+		MinVersion: 170000,
+	},
+	{
+		// since 14 a statement run both at top level and nested has a row
+		// for each, told apart by toplevel
+		Name: "pg_stat_statements",
+		Query: `SELECT s.*, coalesce(r.rolname, '') AS rolname, coalesce(d.datname, '') AS datname
+  FROM pg_stat_statements s
+  LEFT JOIN pg_roles r ON r.oid = s.userid
+  LEFT JOIN pg_database d ON d.oid = s.dbid`,
+		Keys:   []string{"userid", "dbid", "queryid", "toplevel"},
+		Labels: []string{"rolname", "datname", "query"},
+		Counters: []string{"calls", "total_time", "total_exec_time", "rows",
+			"shared_blks_hit", "shared_blks_read", "temp_blks_written"},
+	},
+}
+
+// snapshot is the on-disk format written by pg:snapshot
+type snapshot struct {
+	TakenAt time.Time          `json:"taken_at"`
+	Version string             `json:"server_version"`
+	Views   map[string]*report `json:"views"`
+	Missing map[string]string  `json:"missing,omitempty"`
+}
+
+func takeSnapshot() (*snapshot, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	s := &snapshot{
+		Views:   make(map[string]*report),
+		Missing: make(map[string]string),
+	}
+	err = db.QueryRow("SELECT clock_timestamp(), current_setting('server_version')").Scan(&s.TakenAt, &s.Version)
+	if err != nil {
+		return nil, err
+	}
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, view := range snapshotViews {
+		if version < view.MinVersion {
+			continue
+		}
+		query := view.Query
+		if query == "" {
+			query = "SELECT * FROM " + view.Name
+		}
+		// pg_stat_statements is an extension and may not be installed,
+		// that should not prevent capturing everything else.
+		r, err := queryReport(db, query)
+		if err != nil {
+			s.Missing[view.Name] = err.Error()
+			continue
+		}
+		s.Views[view.Name] = r
+	}
+	return s, nil
+}
+
+func writeSnapshot(filename string, s *snapshot) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	if err := enc.Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readSnapshot(filename string) (*snapshot, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &snapshot{}
+	if err := json.NewDecoder(f).Decode(s); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return s, nil
+}
+
+func snapshotCmd(ctx *cli.Context) error {
+	filename := ctx.Args().First()
+	if filename == "" {
+		filename = fmt.Sprintf("despite-snapshot-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+	}
+	s, err := takeSnapshot()
+	if err == nil {
+		err = writeSnapshot(filename, s)
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	fmt.Printf("captured %d views into %s\n", len(s.Views), filename)
+	for name, reason := range s.Missing {
+		fmt.Printf("skipped %s: %s\n", name, reason)
+	}
+	return nil
+}
+
+// snapshotRates computes per-second rates for view between two snapshots.
+// Rows present in only one snapshot and rows where nothing changed are
+// left out. A counter that went backwards means the stats were reset in
+// between, which is reported rather than shown as a negative rate.
+func snapshotRates(view snapshotView, a, b *snapshot) *report {
+	before, after := a.Views[view.Name], b.Views[view.Name]
+	if before == nil || after == nil {
+		return nil
+	}
+	elapsed := b.TakenAt.Sub(a.TakenAt).Seconds()
+	var counters []string
+	for _, c := range view.Counters {
+		if columnIndex(before, c) >= 0 && columnIndex(after, c) >= 0 {
+			counters = append(counters, c)
+		}
+	}
+	r := &report{Header: append([]string{"Key"}, view.Labels...)}
+	for _, c := range counters {
+		r.Header = append(r.Header, c+"/s")
+	}
+	old := make(map[string][]string, len(before.Rows))
+	for _, row := range before.Rows {
+		old[rowKey(before, view.Keys, row)] = row
+	}
+	keys := make([]string, 0, len(after.Rows))
+	current := make(map[string][]string, len(after.Rows))
+	for _, row := range after.Rows {
+		k := rowKey(after, view.Keys, row)
+		current[k] = row
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		prev, ok := old[k]
+		if !ok {
+			continue
+		}
+		out := []string{k}
+		for _, label := range view.Labels {
+			value := ""
+			if i := columnIndex(after, label); i >= 0 {
+				value = shortQuery(current[k][i], 60)
+			}
+			out = append(out, value)
+		}
+		changed := false
+		for _, c := range counters {
+			x, _ := strconv.ParseFloat(prev[columnIndex(before, c)], 64)
+			y, _ := strconv.ParseFloat(current[k][columnIndex(after, c)], 64)
+			switch {
+			case y < x:
+				out = append(out, "reset")
+				changed = true
+			case elapsed <= 0:
+				out = append(out, "")
+			default:
+				if y != x {
+					changed = true
+				}
+				out = append(out, strconv.FormatFloat((y-x)/elapsed, 'f', 2, 64))
+			}
+		}
+		if changed {
+			r.Append(out)
+		}
+	}
+	return r
+}
+
+func columnIndex(r *report, column string) int {
+	for i, h := range r.Header {
+		if h == column {
+			return i
+		}
+	}
+	return -1
+}
+
+func rowKey(r *report, keys []string, row []string) string {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if i := columnIndex(r, k); i >= 0 {
+			parts = append(parts, row[i])
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func snapshotDiff(output io.Writer, a, b *snapshot) {
+	fmt.Fprintf(output, "%s elapsed between %s and %s\n",
+		b.TakenAt.Sub(a.TakenAt), a.TakenAt.Format(time.RFC3339), b.TakenAt.Format(time.RFC3339))
+	for _, view := range snapshotViews {
+		r := snapshotRates(view, a, b)
+		if r == nil || len(r.Rows) == 0 {
+			continue
+		}
+		fmt.Fprintf(output, "\n%s\n", view.Name)
+		renderReport(output, r)
+	}
+}
+
+func snapshotDiffCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return cli.NewExitError("usage: despite pg:snapshot-diff BEFORE AFTER", 1)
+	}
+	a, err := readSnapshot(ctx.Args().Get(0))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	b, err := readSnapshot(ctx.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	snapshotDiff(os.Stdout, a, b)
+	return nil
+}
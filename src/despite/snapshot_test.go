@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRates(t *testing.T) {
+	view := snapshotView{
+		Name:     "pg_stat_user_tables",
+		Keys:     []string{"schemaname", "relname"},
+		Counters: []string{"seq_scan", "n_tup_ins", "total_exec_time"},
+	}
+	header := []string{"relid", "schemaname", "relname", "seq_scan", "n_tup_ins"}
+	start := time.Date(2016, 9, 1, 12, 0, 0, 0, time.UTC)
+	a := &snapshot{TakenAt: start, Views: map[string]*report{
+		view.Name: {Header: header, Rows: [][]string{
+			{"1", "public", "users", "10", "100"},
+			{"2", "public", "events", "5", "50"},
+			{"3", "public", "idle", "1", "1"},
+		}},
+	}}
+	b := &snapshot{TakenAt: start.Add(10 * time.Second), Views: map[string]*report{
+		view.Name: {Header: header, Rows: [][]string{
+			{"1", "public", "users", "30", "105"},
+			{"2", "public", "events", "0", "50"},
+			{"3", "public", "idle", "1", "1"},
+			{"4", "public", "new", "9", "9"},
+		}},
+	}}
+	r := snapshotRates(view, a, b)
+	expectedHeader := []string{"Key", "seq_scan/s", "n_tup_ins/s"}
+	if !reflect.DeepEqual(r.Header, expectedHeader) {
+		t.Errorf("header is %v, expected %v", r.Header, expectedHeader)
+	}
+	expected := [][]string{
+		{"public.events", "reset", "0.00"},
+		{"public.users", "2.00", "0.50"},
+	}
+	if !reflect.DeepEqual(r.Rows, expected) {
+		t.Errorf("rates are %v, expected %v", r.Rows, expected)
+	}
+}
+
+func TestSnapshotRatesToplevel(t *testing.T) {
+	var view snapshotView
+	for _, v := range snapshotViews {
+		if v.Name == "pg_stat_statements" {
+			view = v
+		}
+	}
+	header := []string{"userid", "dbid", "toplevel", "queryid", "query", "calls", "rolname", "datname"}
+	start := time.Date(2016, 9, 1, 12, 0, 0, 0, time.UTC)
+	a := &snapshot{TakenAt: start, Views: map[string]*report{
+		view.Name: {Header: header, Rows: [][]string{
+			{"10", "5", "true", "42", "SELECT $1", "100", "app", "orders"},
+			{"10", "5", "false", "42", "SELECT $1", "1000", "app", "orders"},
+		}},
+	}}
+	b := &snapshot{TakenAt: start.Add(10 * time.Second), Views: map[string]*report{
+		view.Name: {Header: header, Rows: [][]string{
+			{"10", "5", "true", "42", "SELECT $1", "110", "app", "orders"},
+			{"10", "5", "false", "42", "SELECT $1", "1500", "app", "orders"},
+		}},
+	}}
+	r := snapshotRates(view, a, b)
+	expected := [][]string{
+		{"10.5.42.false", "app", "orders", "SELECT $1", "50.00"},
+		{"10.5.42.true", "app", "orders", "SELECT $1", "1.00"},
+	}
+	if !reflect.DeepEqual(r.Rows, expected) {
+		t.Errorf("rates are %v, expected %v", r.Rows, expected)
+	}
+}
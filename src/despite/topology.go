@@ -0,0 +1,570 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// topologyNode is one server of the cluster, named by the address it was
+// first reached at
+type topologyNode struct {
+	Address  string
+	Role     string
+	Timeline int
+	Version  string
+	Error    string
+}
+
+// topologyLink is replication from one node to another. Kind is physical
+// or logical; a link may be reported by both ends and is merged.
+type topologyLink struct {
+	From  string
+	To    string
+	Kind  string
+	Name  string
+	State string
+	Sync  string
+	Lag   string
+}
+
+func (l topologyLink) key() string {
+	if l.Kind == "logical" {
+		return l.From + " " + l.To + " logical " + l.Name
+	}
+	return l.From + " " + l.To + " " + l.Kind
+}
+
+// mergeLinks combines links reported by both ends, keeping the first
+// value seen for each field
+func mergeLinks(links []topologyLink) []topologyLink {
+	var merged []topologyLink
+	index := make(map[string]int)
+	for _, l := range links {
+		i, ok := index[l.key()]
+		if !ok {
+			index[l.key()] = len(merged)
+			merged = append(merged, l)
+			continue
+		}
+		m := &merged[i]
+		for _, f := range []struct{ dst, src *string }{
+			{&m.Name, &l.Name}, {&m.State, &l.State}, {&m.Sync, &l.Sync}, {&m.Lag, &l.Lag},
+		} {
+			if *f.dst == "" {
+				*f.dst = *f.src
+			}
+		}
+	}
+	return merged
+}
+
+// linkLag describes how far behind a link is, in bytes of WAL, time or both
+func linkLag(bytes, seconds sql.NullFloat64) string {
+	var parts []string
+	if bytes.Valid {
+		parts = append(parts, prettyBytes(bytes.Float64))
+	}
+	if seconds.Valid {
+		d := time.Duration(seconds.Float64 * float64(time.Second))
+		parts = append(parts, d.Round(time.Millisecond).String())
+	}
+	return strings.Join(parts, " / ")
+}
+
+func (n *topologyNode) label(subscriber bool) string {
+	if n.Error != "" {
+		return n.Address + " unreachable: " + n.Error
+	}
+	parts := []string{n.Address, n.Role}
+	if subscriber {
+		parts = append(parts, "subscriber")
+	}
+	if n.Timeline > 0 {
+		parts = append(parts, fmt.Sprintf("timeline %d", n.Timeline))
+	}
+	if n.Version != "" {
+		parts = append(parts, "version "+n.Version)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l topologyLink) label() string {
+	parts := []string{l.Kind}
+	for _, s := range []string{l.State, l.Sync} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if l.Name != "" {
+		parts = append(parts, fmt.Sprintf("%q", l.Name))
+	}
+	if l.Lag != "" {
+		parts = append(parts, "lag "+l.Lag)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// topologyTree draws the nodes as a tree under each node nothing
+// replicates to. A node reached a second time, as in bidirectional logical
+// replication, is only named. Physical children come before logical ones.
+func topologyTree(nodes []*topologyNode, links []topologyLink) string {
+	links = mergeLinks(links)
+	byAddress := make(map[string]*topologyNode)
+	for _, n := range nodes {
+		byAddress[n.Address] = n
+	}
+	children := make(map[string][]topologyLink)
+	incoming := make(map[string]bool)
+	subscriber := make(map[string]bool)
+	for _, l := range links {
+		children[l.From] = append(children[l.From], l)
+		incoming[l.To] = true
+		if l.Kind == "logical" {
+			subscriber[l.To] = true
+		}
+	}
+	for _, c := range children {
+		sort.SliceStable(c, func(i, j int) bool {
+			if c[i].Kind != c[j].Kind {
+				return c[i].Kind == "physical"
+			}
+			return c[i].To < c[j].To
+		})
+	}
+
+	var out bytes.Buffer
+	drawn := make(map[string]bool)
+	var draw func(address, prefix, branch, via string)
+	draw = func(address, prefix, branch, via string) {
+		label := address
+		if n, ok := byAddress[address]; ok {
+			label = n.label(subscriber[address])
+		}
+		if via != "" {
+			label += " " + via
+		}
+		if drawn[address] {
+			fmt.Fprintf(&out, "%s%s%s, see above\n", prefix, branch, label)
+			return
+		}
+		drawn[address] = true
+		fmt.Fprintf(&out, "%s%s%s\n", prefix, branch, label)
+		switch branch {
+		case "├── ":
+			prefix += "│   "
+		case "└── ":
+			prefix += "    "
+		}
+		c := children[address]
+		for i, l := range c {
+			b := "├── "
+			if i == len(c)-1 {
+				b = "└── "
+			}
+			draw(l.To, prefix, b, l.label())
+		}
+	}
+	for _, n := range nodes {
+		if !incoming[n.Address] {
+			draw(n.Address, "", "", "")
+		}
+	}
+	// every node of a replication cycle has a link into it, so start from
+	// one that is not a standby
+	for _, n := range nodes {
+		if !drawn[n.Address] && n.Role != "standby" {
+			draw(n.Address, "", "", "")
+		}
+	}
+	for _, n := range nodes {
+		if !drawn[n.Address] {
+			draw(n.Address, "", "", "")
+		}
+	}
+	return out.String()
+}
+
+// parseConninfo reads a libpq connection string, either key=value pairs
+// or a postgres:// URI
+func parseConninfo(conninfo string) map[string]string {
+	params := make(map[string]string)
+	if strings.HasPrefix(conninfo, "postgres://") || strings.HasPrefix(conninfo, "postgresql://") {
+		u, err := url.Parse(conninfo)
+		if err != nil {
+			return params
+		}
+		for k, v := range u.Query() {
+			params[k] = v[0]
+		}
+		if u.Host != "" {
+			host, port, err := net.SplitHostPort(u.Host)
+			if err != nil {
+				host = u.Host
+			}
+			params["host"] = strings.Trim(host, "[]")
+			if port != "" {
+				params["port"] = port
+			}
+		}
+		return params
+	}
+	for i := 0; i < len(conninfo); {
+		for i < len(conninfo) && conninfo[i] == ' ' {
+			i++
+		}
+		eq := strings.IndexByte(conninfo[i:], '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(conninfo[i : i+eq])
+		i += eq + 1
+		for i < len(conninfo) && conninfo[i] == ' ' {
+			i++
+		}
+		var value bytes.Buffer
+		if i < len(conninfo) && conninfo[i] == '\'' {
+			for i++; i < len(conninfo) && conninfo[i] != '\''; i++ {
+				if conninfo[i] == '\\' && i+1 < len(conninfo) {
+					i++
+				}
+				value.WriteByte(conninfo[i])
+			}
+			i++
+		} else {
+			for ; i < len(conninfo) && conninfo[i] != ' '; i++ {
+				if conninfo[i] == '\\' && i+1 < len(conninfo) {
+					i++
+				}
+				value.WriteByte(conninfo[i])
+			}
+		}
+		params[key] = value.String()
+	}
+	return params
+}
+
+// conninfoAddress is the first host and port a connection string names,
+// or "" when it connects over a local socket
+func conninfoAddress(conninfo string) string {
+	params := parseConninfo(conninfo)
+	host := params["hostaddr"]
+	if host == "" {
+		host = params["host"]
+	}
+	host = strings.Split(host, ",")[0]
+	if host == "" || strings.HasPrefix(host, "/") {
+		return ""
+	}
+	port := strings.Split(params["port"], ",")[0]
+	if port == "" {
+		port = "5432"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// nodeURI is the --dburi with the host and port replaced, so every node is
+// connected to with the same credentials and database
+func nodeURI(base, address string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		return "", fmt.Errorf("--dburi must be a postgres:// URL to connect to other nodes")
+	}
+	q := u.Query()
+	q.Del("host")
+	q.Del("port")
+	if q.Get("connect_timeout") == "" {
+		q.Set("connect_timeout", "5")
+	}
+	u.Host = address
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// uriAddress is the host and port of a postgres:// URL, with the libpq
+// defaults filled in
+func uriAddress(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "localhost:5432"
+	}
+	host, port := u.Hostname(), u.Port()
+	if h := u.Query().Get("host"); h != "" {
+		host = h
+	}
+	if p := u.Query().Get("port"); p != "" {
+		port = p
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "5432"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+type topologyCrawler struct {
+	base    string
+	recurse bool
+	nodes   []*topologyNode
+	// identities maps each running server to the address it was first
+	// reached at, and aliases maps any other address it answered on
+	identities map[string]string
+	aliases    map[string]string
+	visited    map[string]bool
+	queue      []string
+	links      []topologyLink
+	notes      []string
+}
+
+func (c *topologyCrawler) enqueue(address string) {
+	if c.recurse && !c.visited[address] {
+		c.visited[address] = true
+		c.queue = append(c.queue, address)
+	}
+}
+
+func (c *topologyCrawler) canonical(address string) string {
+	if a, ok := c.aliases[address]; ok {
+		return a
+	}
+	return address
+}
+
+// visit connects to the node at address and records what it replicates to
+// and from. Only a failure to reach the first node is an error.
+func (c *topologyCrawler) visit(address, uri string) error {
+	db, err := sql.Open("postgres", uri)
+	if err == nil {
+		defer db.Close()
+		db.SetMaxOpenConns(1)
+		err = db.Ping()
+	}
+	if err != nil {
+		c.nodes = append(c.nodes, &topologyNode{Address: address, Error: err.Error()})
+		return err
+	}
+	// servers that share a system identifier are told apart by when they
+	// started, which needs no privileges to read
+	var identity, serverVersionName string
+	var inRecovery bool
+	err = db.QueryRow(`SELECT pg_postmaster_start_time()::text || ' ' || current_setting('port'),
+    pg_is_in_recovery(), current_setting('server_version')`).Scan(&identity, &inRecovery, &serverVersionName)
+	if err != nil {
+		c.nodes = append(c.nodes, &topologyNode{Address: address, Error: err.Error()})
+		return err
+	}
+	if first, ok := c.identities[identity]; ok {
+		c.aliases[address] = first
+		return nil
+	}
+	c.identities[identity] = address
+	version, err := serverVersion(db)
+	if err != nil {
+		return err
+	}
+	n := &topologyNode{Address: address, Role: "primary", Version: serverVersionName}
+	if inRecovery {
+		n.Role = "standby"
+	}
+	c.nodes = append(c.nodes, n)
+	if version >= 90600 {
+		// the timeline of the last checkpoint, which on a standby is behind
+		// a timeline switch until the next restartpoint
+		db.QueryRow("SELECT timeline_id FROM pg_control_checkpoint()").Scan(&n.Timeline)
+	}
+
+	if err := c.downstream(db, n, version, inRecovery); err != nil {
+		c.notes = append(c.notes, fmt.Sprintf("%s: pg_stat_replication: %s", address, err))
+	}
+	if inRecovery && version >= 90600 {
+		if err := c.upstream(db, n, version); err != nil {
+			c.notes = append(c.notes, fmt.Sprintf("%s: pg_stat_wal_receiver: %s", address, err))
+		}
+	}
+	if version >= 100000 {
+		if err := c.subscriptions(db, n); err != nil {
+			c.notes = append(c.notes, fmt.Sprintf("%s: pg_subscription: %s", address, err))
+		}
+	}
+	return nil
+}
+
+// downstream records the standbys and logical subscribers streaming from
+// n. They are assumed to listen on the same port as n, since
+// pg_stat_replication only shows the port they connect from.
+func (c *topologyCrawler) downstream(db *sql.DB, n *topologyNode, version int, inRecovery bool) error {
+	fn := walFunctionsFor(version)
+	position := fn.current
+	if inRecovery {
+		position = "pg_last_wal_receive_lsn"
+		if version < 100000 {
+			position = "pg_last_xlog_receive_location"
+		}
+	}
+	query := fmt.Sprintf(`SELECT coalesce(r.application_name, ''), coalesce(host(r.client_addr), ''),
+    coalesce(r.state, ''), coalesce(r.sync_state, ''),
+    %s(%s(), r.replay_lsn), extract(epoch FROM r.replay_lag), coalesce(s.slot_type, 'physical')
+  FROM pg_stat_replication r
+  LEFT JOIN pg_replication_slots s ON s.active_pid = r.pid`, fn.diff, position)
+	if version < 100000 {
+		query = fmt.Sprintf(`SELECT coalesce(application_name, ''), coalesce(host(client_addr), ''),
+    coalesce(state, ''), coalesce(sync_state, ''),
+    %s(%s(), replay_location), NULL::float8, 'physical'
+  FROM pg_stat_replication`, fn.diff, position)
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	_, port, _ := net.SplitHostPort(n.Address)
+	for rows.Next() {
+		var l topologyLink
+		var client string
+		var lagBytes, lagSeconds sql.NullFloat64
+		if err := rows.Scan(&l.Name, &client, &l.State, &l.Sync, &lagBytes, &lagSeconds, &l.Kind); err != nil {
+			return err
+		}
+		l.From = n.Address
+		l.Lag = linkLag(lagBytes, lagSeconds)
+		if client == "" {
+			l.To = fmt.Sprintf("[local %s]", l.Name)
+		} else {
+			l.To = net.JoinHostPort(client, port)
+			c.enqueue(l.To)
+		}
+		c.links = append(c.links, l)
+	}
+	return rows.Err()
+}
+
+// upstream records the server the standby n streams from
+func (c *topologyCrawler) upstream(db *sql.DB, n *topologyNode, version int) error {
+	sender := "''"
+	if version >= 110000 {
+		sender = "coalesce(sender_host || ':' || sender_port, '')"
+	}
+	var status, conninfo, senderAddress string
+	var timeline int
+	err := db.QueryRow(fmt.Sprintf(`SELECT status, coalesce(received_tli, 0), coalesce(conninfo, ''), %s
+  FROM pg_stat_wal_receiver`, sender)).Scan(&status, &timeline, &conninfo, &senderAddress)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if timeline > 0 {
+		n.Timeline = timeline
+	}
+	address := conninfoAddress(conninfo)
+	if host, port, err := net.SplitHostPort(senderAddress); err == nil && !strings.HasPrefix(host, "/") {
+		address = net.JoinHostPort(host, port)
+	}
+	if address == "" {
+		if conninfo == "" {
+			c.notes = append(c.notes, n.Address+": reading the upstream of a standby needs superuser or pg_read_all_stats")
+		}
+		return nil
+	}
+	c.links = append(c.links, topologyLink{From: address, To: n.Address, Kind: "physical",
+		Name: parseConninfo(conninfo)["application_name"], State: status})
+	c.enqueue(address)
+	return nil
+}
+
+// subscriptions records the publishers n subscribes to
+func (c *topologyCrawler) subscriptions(db *sql.DB, n *topologyNode) error {
+	rows, err := db.Query(`SELECT DISTINCT ON (s.oid) s.subname, s.subenabled, s.subconninfo,
+    extract(epoch FROM clock_timestamp() - st.latest_end_time)
+  FROM pg_subscription s
+  LEFT JOIN pg_stat_subscription st ON st.subid = s.oid AND st.relid IS NULL
+  ORDER BY s.oid, st.latest_end_time DESC NULLS LAST`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, conninfo string
+		var enabled bool
+		var since sql.NullFloat64
+		if err := rows.Scan(&name, &enabled, &conninfo, &since); err != nil {
+			return err
+		}
+		address := conninfoAddress(conninfo)
+		if address == "" {
+			address = fmt.Sprintf("[local %s]", name)
+		} else {
+			c.enqueue(address)
+		}
+		l := topologyLink{From: address, To: n.Address, Kind: "logical", Name: name, State: "disabled"}
+		if enabled {
+			l.State = ""
+			l.Lag = linkLag(sql.NullFloat64{}, since)
+		}
+		c.links = append(c.links, l)
+	}
+	return rows.Err()
+}
+
+func topology(output io.Writer, recurse bool) error {
+	start := uriAddress(dburi)
+	c := &topologyCrawler{base: dburi, recurse: recurse, identities: make(map[string]string),
+		aliases: make(map[string]string), visited: map[string]bool{start: true}}
+	if err := c.visit(start, dburi); err != nil {
+		return err
+	}
+	for len(c.queue) > 0 {
+		address := c.queue[0]
+		c.queue = c.queue[1:]
+		uri, err := nodeURI(c.base, address)
+		if err != nil {
+			return err
+		}
+		c.visit(address, uri)
+	}
+	for i := range c.links {
+		c.links[i].From = c.canonical(c.links[i].From)
+		c.links[i].To = c.canonical(c.links[i].To)
+	}
+	fmt.Fprint(output, topologyTree(c.nodes, c.links))
+	if len(c.notes) > 0 {
+		fmt.Fprintln(output)
+		for _, note := range c.notes {
+			fmt.Fprintln(output, note)
+		}
+	}
+	return nil
+}
+
+func topologyCmd(ctx *cli.Context) error {
+	if err := topology(os.Stdout, !ctx.Bool("no-recurse")); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// vacuumOptions are the thresholds and limits for pg:vacuum
+type vacuumOptions struct {
+	DeadRatio   float64
+	MinDead     int64
+	FreezeAge   int64
+	Jobs        int
+	LockTimeout time.Duration
+	SkipLocked  bool
+	Execute     bool
+}
+
+// vacuumTarget is a table pg:vacuum decided needs work
+type vacuumTarget struct {
+	Table     string // already quoted
+	DeadRatio float64
+	Vacuum    bool
+	Analyze   bool
+	Freeze    bool
+	Reasons   []string
+}
+
+// vacuumCandidatesQuery returns every user table with the numbers needed
+// to decide what it needs. The table name is quoted for use in VACUUM.
+const vacuumCandidatesQuery = `SELECT format('%I.%I', s.schemaname, s.relname),
+    s.n_dead_tup, s.n_live_tup,
+    coalesce(s.n_mod_since_analyze, 0), c.reltuples::bigint,
+    coalesce(s.last_analyze, s.last_autoanalyze) IS NULL,
+    age(c.relfrozenxid)
+  FROM pg_stat_user_tables s
+    JOIN pg_class c ON c.oid = s.relid
+  ORDER BY age(c.relfrozenxid) DESC, s.n_dead_tup DESC`
+
+// planVacuum picks the tables that need work and what kind of work
+func planVacuum(db *sql.DB, opts vacuumOptions) ([]vacuumTarget, error) {
+	rows, err := db.Query(vacuumCandidatesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var targets []vacuumTarget
+	for rows.Next() {
+		var (
+			table                        string
+			dead, live, modified, tuples int64
+			neverAnalyzed                bool
+			age                          int64
+		)
+		err := rows.Scan(&table, &dead, &live, &modified, &tuples, &neverAnalyzed, &age)
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := vacuumDecision(opts, table, dead, live, modified, tuples, neverAnalyzed, age); ok {
+			targets = append(targets, t)
+		}
+	}
+	return targets, rows.Err()
+}
+
+// vacuumDecision applies the thresholds in opts to one table's statistics
+func vacuumDecision(opts vacuumOptions, table string, dead, live, modified, tuples int64,
+	neverAnalyzed bool, age int64) (vacuumTarget, bool) {
+	t := vacuumTarget{Table: table}
+	if dead+live > 0 {
+		t.DeadRatio = float64(dead) / float64(dead+live)
+	}
+	if age >= opts.FreezeAge {
+		t.Vacuum = true
+		t.Freeze = true
+		t.Reasons = append(t.Reasons, fmt.Sprintf("xid age %d", age))
+	}
+	if dead >= opts.MinDead && t.DeadRatio >= opts.DeadRatio {
+		t.Vacuum = true
+		t.Reasons = append(t.Reasons, fmt.Sprintf("%.0f%% dead tuples", 100*t.DeadRatio))
+	}
+	switch {
+	case neverAnalyzed:
+		t.Analyze = true
+		t.Reasons = append(t.Reasons, "never analyzed")
+	case tuples > 0 && float64(modified)/float64(tuples) >= 0.1:
+		t.Analyze = true
+		t.Reasons = append(t.Reasons, fmt.Sprintf("%d rows modified since analyze", modified))
+	}
+	return t, len(t.Reasons) > 0
+}
+
+// vacuumStatement builds the statement for a target. Tables that only have
+// stale statistics get a plain ANALYZE, which is much cheaper.
+func vacuumStatement(t vacuumTarget, skipLocked bool) string {
+	var options []string
+	if t.Vacuum {
+		if t.Freeze {
+			options = append(options, "FREEZE")
+		}
+		options = append(options, "ANALYZE")
+	}
+	if skipLocked {
+		options = append(options, "SKIP_LOCKED")
+	}
+	command := "ANALYZE"
+	if t.Vacuum {
+		command = "VACUUM"
+	}
+	if len(options) == 0 {
+		return fmt.Sprintf("%s %s", command, t.Table)
+	}
+	return fmt.Sprintf("%s (%s) %s", command, strings.Join(options, ", "), t.Table)
+}
+
+func vacuumPlanReport(targets []vacuumTarget, skipLocked bool) *report {
+	r := &report{Header: []string{"Table", "Reason", "Statement"}}
+	for _, t := range targets {
+		r.Append([]string{t.Table, strings.Join(t.Reasons, ", "), vacuumStatement(t, skipLocked)})
+	}
+	return r
+}
+
+// runVacuum executes the statements with at most opts.Jobs at a time, each
+// on its own connection with lock_timeout set, reporting as they finish. A
+// worker that cannot connect or set lock_timeout stops, and once every
+// worker has stopped the remaining tables count as failed.
+func runVacuum(output io.Writer, db *sql.DB, targets []vacuumTarget, opts vacuumOptions) (failed int) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+	stopped := 0
+	allStopped := make(chan struct{})
+	queue := make(chan vacuumTarget)
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(output, "%s "+format+"\n", append([]interface{}{time.Now().Format("15:04:05")}, args...)...)
+	}
+	stop := func(format string, args ...interface{}) {
+		logf(format, args...)
+		mu.Lock()
+		defer mu.Unlock()
+		stopped++
+		if stopped == opts.Jobs {
+			close(allStopped)
+		}
+	}
+	for i := 0; i < opts.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				stop("could not connect: %s", err)
+				return
+			}
+			defer conn.Close()
+			timeout := fmt.Sprintf("SET lock_timeout = %d", opts.LockTimeout/time.Millisecond)
+			if _, err := conn.ExecContext(ctx, timeout); err != nil {
+				stop("could not set lock_timeout, stopping this worker: %s", err)
+				return
+			}
+			for t := range queue {
+				statement := vacuumStatement(t, opts.SkipLocked)
+				logf("start  %s", statement)
+				began := time.Now()
+				_, err := conn.ExecContext(ctx, statement)
+				mu.Lock()
+				done++
+				progress := fmt.Sprintf("[%d/%d]", done, len(targets))
+				if err != nil {
+					failed++
+				}
+				mu.Unlock()
+				if err != nil {
+					logf("failed %s %s after %s: %s", progress, t.Table, time.Since(began).Truncate(time.Millisecond), err)
+					continue
+				}
+				logf("done   %s %s in %s", progress, t.Table, time.Since(began).Truncate(time.Millisecond))
+			}
+		}()
+	}
+feed:
+	for i, t := range targets {
+		select {
+		case queue <- t:
+		case <-allStopped:
+			mu.Lock()
+			failed += len(targets) - i
+			mu.Unlock()
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return failed
+}
+
+func vacuum(output io.Writer, opts vacuumOptions) error {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if opts.SkipLocked {
+		version, err := serverVersion(db)
+		if err != nil {
+			return err
+		}
+		if version < 120000 {
+			return fmt.Errorf("--skip-locked needs PostgreSQL 12 or later, use --lock-timeout instead")
+		}
+	}
+	targets, err := planVacuum(db, opts)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(output, "no tables need vacuuming")
+		return nil
+	}
+	renderReport(output, vacuumPlanReport(targets, opts.SkipLocked))
+	if !opts.Execute {
+		fmt.Fprintln(output, "\nthis is the plan only, run again with --execute to vacuum these tables")
+		return nil
+	}
+	fmt.Fprintf(output, "\nrunning %d statements, %d at a time\n", len(targets), opts.Jobs)
+	db.SetMaxOpenConns(opts.Jobs)
+	if failed := runVacuum(output, db, targets, opts); failed > 0 {
+		return fmt.Errorf("%d of %d statements failed", failed, len(targets))
+	}
+	return nil
+}
+
+func vacuumCmd(ctx *cli.Context) error {
+	opts := vacuumOptions{
+		DeadRatio:   ctx.Float64("dead-ratio"),
+		MinDead:     ctx.Int64("min-dead"),
+		FreezeAge:   ctx.Int64("freeze-age"),
+		Jobs:        ctx.Int("jobs"),
+		LockTimeout: ctx.Duration("lock-timeout"),
+		SkipLocked:  ctx.Bool("skip-locked"),
+		Execute:     ctx.Bool("execute"),
+	}
+	if opts.Jobs < 1 {
+		return cli.NewExitError("--jobs must be at least 1", 1)
+	}
+	err := vacuum(os.Stdout, opts)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
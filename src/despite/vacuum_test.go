@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestVacuumStatement(t *testing.T) {
+	opts := vacuumOptions{DeadRatio: 0.2, MinDead: 1000, FreezeAge: 150000000}
+	cases := []struct {
+		dead, live, modified, tuples int64
+		neverAnalyzed                bool
+		age                          int64
+		skipLocked                   bool
+		statement                    string
+	}{
+		{5000, 10000, 0, 15000, false, 1000, false, `VACUUM (ANALYZE) public.t`},
+		{0, 10000, 0, 10000, false, 200000000, true, `VACUUM (FREEZE, ANALYZE, SKIP_LOCKED) public.t`},
+		{0, 10000, 5000, 10000, false, 1000, false, `ANALYZE public.t`},
+		{0, 0, 0, 0, true, 1000, true, `ANALYZE (SKIP_LOCKED) public.t`},
+	}
+	for _, c := range cases {
+		target, ok := vacuumDecision(opts, "public.t", c.dead, c.live, c.modified, c.tuples, c.neverAnalyzed, c.age)
+		if !ok {
+			t.Errorf("expected work for %+v", c)
+			continue
+		}
+		if s := vacuumStatement(target, c.skipLocked); s != c.statement {
+			t.Errorf("statement is %q, expected %q", s, c.statement)
+		}
+	}
+	if _, ok := vacuumDecision(opts, "public.t", 10, 10000, 10, 10000, false, 1000); ok {
+		t.Errorf("healthy table should not need work")
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/urfave/cli"
+)
+
+// walFunctions names the WAL functions, which were renamed from xlog in 10
+type walFunctions struct {
+	current string
+	replay  string
+	diff    string
+}
+
+func walFunctionsFor(version int) walFunctions {
+	if version < 100000 {
+		return walFunctions{"pg_current_xlog_location", "pg_last_xlog_replay_location", "pg_xlog_location_diff"}
+	}
+	return walFunctions{"pg_current_wal_lsn", "pg_last_wal_replay_lsn", "pg_wal_lsn_diff"}
+}
+
+// archiverStats is the single row of pg_stat_archiver
+type archiverStats struct {
+	ArchiveMode      string
+	Archived         int64
+	LastArchivedWal  string
+	LastArchivedTime sql.NullString
+	Failed           int64
+	LastFailedWal    string
+	LastFailedTime   sql.NullString
+	LastArchivedAt   pq.NullTime
+	LastFailedAt     pq.NullTime
+}
+
+// failing is true when the most recent archive attempt failed
+func (a *archiverStats) failing() bool {
+	if !a.LastFailedAt.Valid {
+		return false
+	}
+	return !a.LastArchivedAt.Valid || a.LastFailedAt.Time.After(a.LastArchivedAt.Time)
+}
+
+func readArchiverStats(db *sql.DB) (*archiverStats, error) {
+	a := &archiverStats{}
+	err := db.QueryRow(`SELECT current_setting('archive_mode'),
+    archived_count, coalesce(last_archived_wal, ''), last_archived_time::text,
+    failed_count, coalesce(last_failed_wal, ''), last_failed_time::text,
+    last_archived_time, last_failed_time
+  FROM pg_stat_archiver`).Scan(&a.ArchiveMode, &a.Archived, &a.LastArchivedWal, &a.LastArchivedTime,
+		&a.Failed, &a.LastFailedWal, &a.LastFailedTime, &a.LastArchivedAt, &a.LastFailedAt)
+	return a, err
+}
+
+// walRate samples the WAL position twice, interval apart, and returns the
+// bytes of WAL per second. position is the function reporting the current
+// WAL position, which on a standby is the replay position.
+func walRate(db *sql.DB, fn walFunctions, position string, interval time.Duration) (float64, error) {
+	var start string
+	if err := db.QueryRow(fmt.Sprintf("SELECT %s()::text", position)).Scan(&start); err != nil {
+		return 0, err
+	}
+	began := time.Now()
+	time.Sleep(interval)
+	var bytes float64
+	err := db.QueryRow(fmt.Sprintf("SELECT %s(%s(), $1::pg_lsn)", fn.diff, position), start).Scan(&bytes)
+	if err != nil {
+		return 0, err
+	}
+	return bytes / time.Since(began).Seconds(), nil
+}
+
+// prettyBytes formats a byte count like pg_size_pretty
+func prettyBytes(b float64) string {
+	s := prettyBytesDelta(b)
+	if b >= 0 {
+		return s[1:]
+	}
+	return s
+}
+
+func walReport(interval time.Duration) (*report, error) {
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	fn := walFunctionsFor(version)
+	var recovery bool
+	if err := db.QueryRow("SELECT pg_is_in_recovery()").Scan(&recovery); err != nil {
+		return nil, err
+	}
+	position := fn.current
+	if recovery {
+		position = fn.replay
+	}
+	r := &report{Header: []string{"Metric", "Value"}}
+
+	rate, err := walRate(db, fn, position, interval)
+	if err != nil {
+		return nil, err
+	}
+	r.Append([]string{"WAL generated per second", prettyBytes(rate)})
+
+	// pg_ls_waldir needs superuser or pg_monitor, report rather than fail
+	var files int64
+	var size sql.NullFloat64
+	err = db.QueryRow("SELECT count(*), sum(size) FROM pg_ls_waldir()").Scan(&files, &size)
+	if err != nil {
+		r.Append([]string{"WAL directory size", "unavailable: " + err.Error()})
+	} else {
+		r.Append([]string{"WAL directory size", prettyBytes(size.Float64)})
+		r.Append([]string{"WAL directory files", strconv.FormatInt(files, 10)})
+	}
+
+	keep := "wal_keep_size"
+	if version < 130000 {
+		keep = "wal_keep_segments"
+	}
+	var keepValue string
+	if err := db.QueryRow("SELECT current_setting($1)", keep).Scan(&keepValue); err != nil {
+		return nil, err
+	}
+	r.Append([]string{keep, keepValue})
+
+	a, err := readArchiverStats(db)
+	if err != nil {
+		return nil, err
+	}
+	r.Append([]string{"archive_mode", a.ArchiveMode})
+	r.Append([]string{"archived", strconv.FormatInt(a.Archived, 10)})
+	r.Append([]string{"last archived WAL", a.LastArchivedWal})
+	r.Append([]string{"last archived at", a.LastArchivedTime.String})
+	r.Append([]string{"archive failures", strconv.FormatInt(a.Failed, 10)})
+	r.Append([]string{"last failed WAL", a.LastFailedWal})
+	r.Append([]string{"last failed at", a.LastFailedTime.String})
+	if a.failing() {
+		r.Notes = append(r.Notes, fmt.Sprintf("ARCHIVING IS FAILING: %s could not be archived at %s. "+
+			"WAL will accumulate in pg_wal until archive_command succeeds, check the server log",
+			a.LastFailedWal, a.LastFailedTime.String))
+	}
+
+	slots, err := db.Query(fmt.Sprintf(`SELECT slot_name, active,
+    coalesce(%s(%s(), restart_lsn), 0)
+  FROM pg_replication_slots
+  ORDER BY 3 DESC`, fn.diff, position))
+	if err != nil {
+		return nil, err
+	}
+	defer slots.Close()
+	for slots.Next() {
+		var name string
+		var active bool
+		var retained float64
+		if err := slots.Scan(&name, &active, &retained); err != nil {
+			return nil, err
+		}
+		r.Append([]string{"slot " + name + " retains", prettyBytes(retained)})
+		if !active {
+			r.Notes = append(r.Notes, fmt.Sprintf("replication slot %s is inactive and retains %s of WAL",
+				name, prettyBytes(retained)))
+		}
+	}
+	return r, slots.Err()
+}
+
+func walCmd(ctx *cli.Context) error {
+	interval := ctx.Duration("interval")
+	return runReport(ctx, func() (*report, error) {
+		return walReport(interval)
+	})
+}
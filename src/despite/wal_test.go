@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestWALFunctionsFor(t *testing.T) {
+	if fn := walFunctionsFor(90600); fn.current != "pg_current_xlog_location" || fn.diff != "pg_xlog_location_diff" {
+		t.Errorf("9.6 functions are %v", fn)
+	}
+	if fn := walFunctionsFor(100000); fn.current != "pg_current_wal_lsn" || fn.replay != "pg_last_wal_replay_lsn" {
+		t.Errorf("10 functions are %v", fn)
+	}
+}
+
+func TestArchiverFailing(t *testing.T) {
+	earlier := pq.NullTime{Time: time.Date(2016, 9, 1, 12, 0, 0, 0, time.UTC), Valid: true}
+	later := pq.NullTime{Time: earlier.Time.Add(time.Minute), Valid: true}
+	cases := []struct {
+		archived, failed pq.NullTime
+		failing          bool
+	}{
+		{pq.NullTime{}, pq.NullTime{}, false},
+		{earlier, pq.NullTime{}, false},
+		{pq.NullTime{}, earlier, true},
+		{earlier, later, true},
+		{later, earlier, false},
+	}
+	for _, c := range cases {
+		a := &archiverStats{LastArchivedAt: c.archived, LastFailedAt: c.failed}
+		if a.failing() != c.failing {
+			t.Errorf("archived %v, failed %v: failing is %v, expected %v",
+				c.archived, c.failed, a.failing(), c.failing)
+		}
+	}
+}
+
+func TestPrettyBytes(t *testing.T) {
+	cases := map[float64]string{
+		0:                "0 bytes",
+		10239:            "10239 bytes",
+		10240:            "10 kB",
+		10*1024*1024 - 1: "10240 kB",
+		10 * 1024 * 1024: "10 MB",
+		10 << 30:         "10 GB",
+		10 << 40:         "10 TB",
+		-20480:           "-20 kB",
+	}
+	for b, expected := range cases {
+		if s := prettyBytes(b); s != expected {
+			t.Errorf("prettyBytes(%v) is %q, expected %q", b, s, expected)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2016 Kindly Ops, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/urfave/cli"
+)
+
+const (
+	clearScreen    = "\033[H\033[2J"
+	highlightStart = "\033[7m"
+	highlightEnd   = "\033[0m"
+)
+
+// quantityPattern matches plain numbers and the units pg_size_pretty emits
+var quantityPattern = regexp.MustCompile(`^(-?[0-9]+(?:\.[0-9]+)?)\s*(bytes|kB|MB|GB|TB)?$`)
+
+var sizeUnits = []struct {
+	name  string
+	bytes float64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"kB", 1 << 10},
+}
+
+// runReport is the Action body shared by every tabular command. It renders
+// the report once, or keeps redrawing it when the global --watch flag is set.
+func runReport(ctx *cli.Context, fetch reportFunc) error {
+	var err error
+	interval := ctx.GlobalDuration("watch")
+	if interval > 0 {
+		interactive := isatty.IsTerminal(os.Stdout.Fd())
+		err = watch(os.Stdout, interval, ctx.Command.Name, fetch, interactive)
+	} else {
+		var r *report
+		r, err = fetch()
+		if err == nil {
+			renderReport(os.Stdout, r)
+		}
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s", err), 1)
+	}
+	return nil
+}
+
+// watch re-runs fetch every interval until the process is interrupted.
+// On a terminal the screen is redrawn in place and changed cells are shown
+// in reverse video; otherwise each iteration is appended to the output.
+// A failed iteration is reported and retried, so that a connection blip
+// does not end a watch left running during an incident.
+func watch(output io.Writer, interval time.Duration, title string, fetch reportFunc, interactive bool) error {
+	var previous *report
+	for {
+		current, err := fetch()
+		if interactive {
+			fmt.Fprint(output, clearScreen)
+		}
+		fmt.Fprintf(output, "Every %s: %s\t%s\n\n", interval, title, time.Now().Format(time.RFC1123))
+		if err != nil {
+			fmt.Fprintf(output, "%s\n", err)
+		} else {
+			renderReport(output, diffReports(previous, current, interactive))
+			previous = current
+		}
+		if !interactive {
+			fmt.Fprintln(output)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// diffReports returns a copy of current annotated against previous. Rows are
+// matched on the report's key columns. Cells that changed are highlighted when
+// highlight is set, and numeric cells gain the delta since the previous run.
+// Rows that did not exist before are highlighted as a whole.
+func diffReports(previous, current *report, highlight bool) *report {
+	if previous == nil {
+		return current
+	}
+	before := make(map[string][]string, len(previous.Rows))
+	for _, row := range previous.Rows {
+		if len(row) > 0 {
+			before[previous.rowKey(row)] = row
+		}
+	}
+	mark := func(s string) string {
+		if highlight {
+			return highlightStart + s + highlightEnd
+		}
+		return s
+	}
+	diffed := &report{Header: current.Header, Notes: current.Notes, Key: current.Key}
+	for _, row := range current.Rows {
+		out := make([]string, len(row))
+		copy(out, row)
+		old, found := before[current.rowKey(row)]
+		for i, cell := range row {
+			switch {
+			case !found:
+				out[i] = mark(cell)
+			case current.isKey(i) || i >= len(old) || old[i] == cell:
+			default:
+				if delta, ok := quantityDelta(old[i], cell); ok {
+					cell = fmt.Sprintf("%s (%s)", cell, delta)
+				}
+				out[i] = mark(cell)
+			}
+		}
+		diffed.Append(out)
+	}
+	return diffed
+}
+
+// quantityDelta formats the signed difference between two numeric cells,
+// keeping the unit style of the input. ok is false if either cell is not
+// a number or a pg_size_pretty size.
+func quantityDelta(before, after string) (delta string, ok bool) {
+	b, bUnit, ok := parseQuantity(before)
+	if !ok {
+		return "", false
+	}
+	a, aUnit, ok := parseQuantity(after)
+	if !ok {
+		return "", false
+	}
+	if bUnit != aUnit && (bUnit == "" || aUnit == "") {
+		return "", false
+	}
+	d := a - b
+	if aUnit != "" {
+		return prettyBytesDelta(d), true
+	}
+	if d == math.Trunc(d) {
+		return fmt.Sprintf("%+d", int64(d)), true
+	}
+	return fmt.Sprintf("%+.2f", d), true
+}
+
+// parseQuantity parses a number, returning sizes in bytes. unit is empty for
+// plain numbers and "bytes" for anything formatted by pg_size_pretty.
+func parseQuantity(s string) (value float64, unit string, ok bool) {
+	m := quantityPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, "", false
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, "", false
+	}
+	if m[2] == "" {
+		return value, "", true
+	}
+	for _, u := range sizeUnits {
+		if u.name == m[2] {
+			return value * u.bytes, "bytes", true
+		}
+	}
+	return value, "bytes", true
+}
+
+// prettyBytesDelta formats a signed byte count the way pg_size_pretty does,
+// switching units once the value reaches ten of the next unit.
+func prettyBytesDelta(d float64) string {
+	abs := math.Abs(d)
+	for _, u := range sizeUnits {
+		if abs >= 10*u.bytes {
+			return fmt.Sprintf("%+d %s", int64(math.Floor(d/u.bytes+0.5)), u.name)
+		}
+	}
+	return fmt.Sprintf("%+d bytes", int64(d))
+}
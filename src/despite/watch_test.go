@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffReportsAnnotatesChangedCells(t *testing.T) {
+	header := []string{"Name", "TotalSize", "Rows"}
+	previous := &report{Header: header, Rows: [][]string{
+		{"users", "16 kB", "10"},
+		{"events", "8192 bytes", "3"},
+	}}
+	current := &report{Header: header, Rows: [][]string{
+		{"users", "16 kB", "12"},
+		{"events", "48 kB", "3"},
+		{"audit", "0 bytes", "0"},
+	}}
+	got := diffReports(previous, current, false)
+	expected := [][]string{
+		{"users", "16 kB", "12 (+2)"},
+		{"events", "48 kB (+40 kB)", "3"},
+		{"audit", "0 bytes", "0"},
+	}
+	if !reflect.DeepEqual(got.Rows, expected) {
+		t.Errorf("diffReports rows are:\n%v\nexpected:\n%v", got.Rows, expected)
+	}
+}
+
+func TestDiffReportsHighlightsNewRows(t *testing.T) {
+	previous := &report{Header: []string{"Name"}}
+	current := &report{Header: []string{"Name"}, Rows: [][]string{{"audit"}}}
+	got := diffReports(previous, current, true)
+	expected := highlightStart + "audit" + highlightEnd
+	if got.Rows[0][0] != expected {
+		t.Errorf("new row is %q, expected %q", got.Rows[0][0], expected)
+	}
+}
+
+func TestQuantityDelta(t *testing.T) {
+	cases := []struct {
+		before, after, delta string
+		ok                   bool
+	}{
+		{"10", "7", "-3", true},
+		{"1.5", "2", "+0.50", true},
+		{"9 MB", "29 MB", "+20 MB", true},
+		{"100 bytes", "2 kB", "+1948 bytes", true},
+		{"idle", "active", "", false},
+		{"10", "10 kB", "", false},
+	}
+	for _, c := range cases {
+		delta, ok := quantityDelta(c.before, c.after)
+		if delta != c.delta || ok != c.ok {
+			t.Errorf("quantityDelta(%q, %q) = %q, %v; expected %q, %v",
+				c.before, c.after, delta, ok, c.delta, c.ok)
+		}
+	}
+}
+
+func TestDiffReportsMatchesFindingsOnSubject(t *testing.T) {
+	previous := findingsReport("Role", []finding{
+		{severityHigh, "app", "can log in without a password"},
+		{severityHigh, "admin", "is a superuser"},
+	})
+	current := findingsReport("Role", []finding{
+		{severityHigh, "admin", "is a superuser"},
+		{severityLow, "app", "can log in without a password"},
+	})
+	got := diffReports(previous, current, true)
+	expected := [][]string{
+		{"HIGH", "admin", "is a superuser"},
+		{highlightStart + "LOW" + highlightEnd, "app", "can log in without a password"},
+	}
+	if !reflect.DeepEqual(got.Rows, expected) {
+		t.Errorf("diffReports rows are:\n%q\nexpected:\n%q", got.Rows, expected)
+	}
+}